@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -11,21 +17,28 @@ import (
 	"syscall"
 	"time"
 
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/config"
 	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/database"
 	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/health"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/metrics"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/outbound"
 	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/subscriptions"
 	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
 	tgBot "github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 const (
-	trainInfoCommand   = "/train_info"
-	stationInfoCommand = "/station_info"
-	routeCommand       = "/route"
-	cancelCommand      = "/cancel"
+	trainInfoCommand     = "/train_info"
+	stationInfoCommand   = "/station_info"
+	routeCommand         = "/route"
+	commutesCommand      = "/commutes"
+	subscriptionsCommand = "/subscriptions"
+	cancelCommand        = "/cancel"
 
 	initialMessage = `Hello. 😄
 
@@ -34,6 +47,8 @@ You can send the following commands:
 ` + trainInfoCommand + ` - Find information about a certain train.
 ` + stationInfoCommand + ` - Find departures or arrivals at a certain station.
 ` + routeCommand + ` - Find trains for a certain route.
+` + commutesCommand + ` - Manage the trains you take regularly.
+` + subscriptionsCommand + ` - See and manage the trains you are subscribed to.
 
 You may use ` + cancelCommand + ` to cancel any ongoing command.`
 	waitingForTrainNumberMessage = "Please send the number of the train you want information for."
@@ -44,67 +59,425 @@ You may use ` + cancelCommand + ` to cancel any ongoing command.`
 You may also send the date as a message in the following formats: dd.mm.yyyy, m/d/yyyy, yyyy-mm-dd, UNIX timestamp.
 
 Keep in mind that, for night trains, this date might be yesterday.`
-	invalidDateMessage = "Invalid date. Please try again or use " + cancelCommand + " to cancel."
+	invalidDateMessage           = "Invalid date. Please try again or use " + cancelCommand + " to cancel."
+	waitingForStationNameMessage = "Please send the name of the station."
+	chooseStationKindMessage     = "Do you want to see the arrivals or the departures for %s?"
+	invalidStationKindMessage    = "Please choose either arrivals or departures, or use " + cancelCommand + " to cancel."
+	chooseStationWindowMessage   = `Please choose the time interval you want to see.
+
+You may also send a date as a message in the following formats: dd.mm.yyyy, m/d/yyyy, yyyy-mm-dd, UNIX timestamp. The whole day will be shown.`
+	waitingForOriginMessage      = "Please send the name of the departure station."
+	waitingForDestinationMessage = "Please send the name of the arrival station."
+	chooseRouteDateMessage       = `Please choose the date of travel.
+
+You may also send the date as a message in the following formats: dd.mm.yyyy, m/d/yyyy, yyyy-mm-dd, UNIX timestamp.`
+	waitingForCommuteTrainMessage = "Please send the number of the train you take for your commute."
+	commuteTrainNotFoundMessage   = "Could not find train %s running today. Please try again or use " + cancelCommand + " to cancel."
+	invalidCommuteDaysMessage     = "Invalid days. Please send the days as, for example, mon tue fri, or use " + cancelCommand + " to cancel."
+	chooseCommuteWindowMessage    = `Please send the time interval in which you take the train, for example 07:00-08:30.
+
+A tracked message will be posted at the start of the interval on each chosen day.`
+	invalidCommuteWindowMessage = "Invalid time interval. Please send it as HH:MM-HH:MM, or use " + cancelCommand + " to cancel."
+	commuteAddedMessage         = "Commute added."
+	trainLookupFailedMessage    = "Could not get the information about train %s. Please try again later."
+	arrivalsButton              = "Arrivals"
+	departuresButton            = "Departures"
+
+	// Same as the bot library's default
+	pollTimeout = time.Minute
+
+	migrateUsage = `Usage: %s migrate [command]
+
+Commands:
+  up [version]    Apply migrations up to version, or all of them (default)
+  down [version]  Roll back migrations down to version, or the last one
+  status          List the migrations and whether they were applied
+`
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(os.Args[2:]))
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	log.SetOutput(os.Stderr)
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Invalid config", logging.Err(err))
+		os.Exit(1)
+	}
+	setupLogging(&cfg)
+	polling := pollingConfig(&cfg)
 
-	botToken := os.Getenv("CFR_BOT.TOKEN")
-	botToken = strings.TrimSpace(botToken)
-	if len(botToken) == 0 {
-		log.Fatal("ERROR: No bot token supplied; supply with CFR_BOT.TOKEN")
+	db, err := openDatabase(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.MigrateOnStart {
+		err = database.MigrateUp(db)
+	} else {
+		err = database.CheckSchema(db)
 	}
+	if err != nil {
+		slog.Error("Database schema is not usable", logging.Err(err))
+		os.Exit(1)
+	}
+	chatFlows := handlers.NewChatFlowStore(db)
 
-	dbPath := os.Getenv("CFR_BOT.DB_PATH")
-	dbPath = strings.TrimSpace(dbPath)
-	if len(dbPath) == 0 {
-		dbPath = "bot_db.sqlite"
+	if len(cfg.ApiUrl) == 0 {
+		cfg.ApiUrl = api.DefaultApiUrl
 	}
-	log.Printf("INFO : DB Path: %s\n", dbPath)
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	slog.Info("Using API", "url", cfg.ApiUrl)
+	apiClient, err := api.NewClient(api.ClientConfig{
+		BaseUrl: cfg.ApiUrl,
+	})
 	if err != nil {
-		panic(err)
+		slog.Error("Could not create API client", logging.Err(err))
+		os.Exit(1)
 	}
-	if err := db.AutoMigrate(&handlers.ChatFlow{}); err != nil {
-		panic(err)
+	var source api.TrainDataSource = apiClient
+	if len(cfg.FixturesDir) != 0 {
+		// Replay recorded responses instead of using the network, for testing
+		slog.Info("Using fixtures", "dir", cfg.FixturesDir)
+		source = api.NewFixtureSource(os.DirFS(cfg.FixturesDir))
 	}
-	if err := db.AutoMigrate(&subscriptions.SubData{}); err != nil {
+	source = metrics.NewInstrumentedSource(source)
+	cachedSource := api.NewCachedSource(source, api.DefaultTrainCacheTTL)
+	source = cachedSource
+
+	stations, err := api.LoadStationIndex(ctx, source, db)
+	if err != nil {
+		slog.Warn("Could not load station list", logging.Err(err))
+	} else {
+		go stations.KeepFresh(ctx, source, db)
+	}
+
+	subBot, err := tgBot.New(cfg.Token)
+	if err != nil {
 		panic(err)
 	}
-	database.SetDatabase(db)
+	// All messages are sent through the dispatcher to respect rate limits
+	dispatcher := outbound.NewDispatcher(subBot, outbound.DefaultRateLimitConfig)
+	go dispatcher.Run(ctx)
+	go logStats(ctx, cachedSource, dispatcher)
 
-	subBot, err := tgBot.New(botToken)
+	subs, err := subscriptions.LoadSubscriptions(subscriptions.NewSubscriptionStore(db), dispatcher.Sender(outbound.PriorityBackground), source)
+	if err != nil {
+		slog.Error("Could not load subscriptions", logging.Err(err))
+		os.Exit(1)
+	}
+
+	// The checker releases its train leases when it stops, so wait for it
+	checkerDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-checkerDone
+	}()
+	go func() {
+		defer close(checkerDone)
+		subs.CheckSubscriptions(ctx, polling)
+	}()
+
+	bot, err := tgBot.New(cfg.Token, tgBot.WithHTTPClient(pollTimeout, &health.PollRecorder{
+		Client: &http.Client{Timeout: pollTimeout},
+	}), tgBot.WithDefaultHandler(handlerBuilder(dispatcher.Sender(outbound.PriorityInteractive), chatFlows, source, subs, stations, polling.UnsubscribeGracePeriod)))
 	if err != nil {
 		panic(err)
 	}
-	subs, err := subscriptions.LoadSubscriptions(subBot)
+
+	registerMetrics(cachedSource, dispatcher, subs)
+	// Handlers served on each listen address
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(addr string) *http.ServeMux {
+		if _, ok := muxes[addr]; !ok {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	healthConfig := health.DefaultConfig
+	healthConfig.PingDB = func(ctx context.Context) error {
+		return database.Ping(ctx, db)
+	}
+	webhookSecret := cfg.WebhookSecret
+	if len(cfg.WebhookUrl) != 0 {
+		healthConfig.MaxTelegramUpdateAge = 0
+		if len(webhookSecret) == 0 {
+			webhookSecret = randomSecret()
+		}
+		webhookUrl, _ := url.Parse(cfg.WebhookUrl)
+		webhookPath := webhookUrl.Path
+		if len(webhookPath) == 0 {
+			webhookPath = "/"
+		}
+		getMux(cfg.WebhookAddr).Handle(webhookPath, webhookHandler(webhookSecret, bot.WebhookHandler()))
+	}
+	if len(cfg.HttpAddr) != 0 {
+		mux := getMux(cfg.HttpAddr)
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/healthz", healthConfig.LivenessHandler())
+		mux.Handle("/readyz", healthConfig.ReadinessHandler())
+	}
+	for addr, mux := range muxes {
+		go serveHttp(ctx, addr, mux)
+	}
+
+	if len(cfg.WebhookUrl) == 0 {
+		// A webhook left over from an unclean shutdown would make polling fail
+		if _, err := bot.DeleteWebhook(ctx, &tgBot.DeleteWebhookParams{}); err != nil {
+			slog.Warn("Could not delete webhook", logging.Err(err))
+		}
+		slog.Info("Starting with long polling")
+		bot.Start(ctx)
+		return
+	}
+
+	_, err = bot.SetWebhook(ctx, &tgBot.SetWebhookParams{
+		URL:         cfg.WebhookUrl,
+		SecretToken: webhookSecret,
+	})
+	if err != nil {
+		slog.Error("Could not set webhook", logging.Err(err))
+		os.Exit(1)
+	}
+	slog.Info("Starting with webhook", "url", cfg.WebhookUrl, "addr", cfg.WebhookAddr)
+	bot.StartWebhook(ctx)
+	if !cfg.DeleteWebhookOnShutdown() {
+		return
+	}
+
+	// ctx is done, so deregister with a new one
+	deleteCtx, deleteCancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer deleteCancel()
+	if _, err := bot.DeleteWebhook(deleteCtx, &tgBot.DeleteWebhookParams{}); err != nil {
+		slog.Warn("Could not delete webhook", logging.Err(err))
+	}
+}
+
+func setupLogging(cfg *config.Config) {
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	slog.SetDefault(logging.NewLogger(os.Stderr, level))
+	logging.LogMessageText = cfg.LogMessageText
+}
+
+func openDatabase(cfg *config.Config) (*gorm.DB, error) {
+	if len(cfg.PostgresDsn) != 0 {
+		// The DSN may contain a password, so it isn't logged
+		slog.Info("Opening PostgreSQL database")
+		return database.OpenPostgres(cfg.PostgresDsn)
+	}
+	slog.Info("Opening database", "path", cfg.DBPath)
+	return database.Open(cfg.DBPath)
+}
+
+// pollingConfig returns the subscription polling settings, keeping the
+// defaults for the ones that aren't configurable.
+func pollingConfig(cfg *config.Config) subscriptions.PollingConfig {
+	polling := subscriptions.DefaultPollingConfig.WithIntervals(time.Duration(cfg.PollMinInterval), time.Duration(cfg.PollMaxInterval))
+	polling.WorkerCount = cfg.WorkerCount
+	polling.InstanceId = cfg.InstanceId
+	polling.UnsubscribeGracePeriod = time.Duration(cfg.UnsubscribeGracePeriod)
+	return polling
+}
+
+// migrateCommand applies or rolls back schema migrations without starting
+// the bot, and returns the exit code.
+func migrateCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		return 2
+	}
+
+	cfg, err := config.Read()
+	if err == nil {
+		err = cfg.ValidateDatabase()
+	}
 	if err != nil {
-		subs = nil
-		fmt.Printf("WARN : Could not load subscriptions: %s\n", err.Error())
+		slog.Error("Invalid config", logging.Err(err))
+		return 1
 	}
+	setupLogging(&cfg)
 
-	go subs.CheckSubscriptions(ctx)
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if len(args) > 2 || (command == "status" && len(args) > 1) {
+		return usage()
+	}
 
-	bot, err := tgBot.New(botToken, tgBot.WithDefaultHandler(handlerBuilder(subs)))
+	db, err := openDatabase(&cfg)
+	if err != nil {
+		slog.Error("Could not open database", logging.Err(err))
+		return 1
+	}
+	current, err := database.SchemaVersion(db)
 	if err != nil {
+		slog.Error("Could not read schema version", logging.Err(err))
+		return 1
+	}
+
+	var target int
+	switch command {
+	case "status":
+		statuses, err := database.Status(db)
+		if err != nil {
+			slog.Error("Could not read migrations", logging.Err(err))
+			return 1
+		}
+		fmt.Printf("Schema version %d, latest %d\n", current, database.LatestVersion())
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s  %s\n", status.Version, status.Name, applied)
+		}
+		return 0
+	case "up":
+		target = database.LatestVersion()
+	case "down":
+		target = current - 1
+	default:
+		return usage()
+	}
+	if len(args) == 2 {
+		target, err = strconv.Atoi(args[1])
+		if err != nil {
+			return usage()
+		}
+	}
+	if (command == "up" && target < current) || (command == "down" && target > current) {
+		slog.Error("Cannot migrate "+command, "from", current, "to", target)
+		return 1
+	}
+	if target < 0 {
+		slog.Info("Nothing to roll back")
+		return 0
+	}
+
+	slog.Info("Migrating database", "from", current, "to", target)
+	if err := database.MigrateTo(db, target); err != nil {
+		slog.Error("Migration failed", logging.Err(err))
+		return 1
+	}
+	slog.Info("Database migrated", "version", target)
+	return 0
+}
+
+func logStats(ctx context.Context, source *api.CachedSource, dispatcher *outbound.Dispatcher) {
+	ticker := time.NewTicker(time.Minute * 15)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats := source.Stats()
+			slog.Info("Train cache stats", "hits", stats.Hits, "coalesced", stats.Coalesced, "misses", stats.Misses)
+			sendStats := dispatcher.Stats()
+			slog.Info("Telegram request stats", "sent", sendStats.Sent, "failed", sendStats.Failed, "rate_limited", sendStats.RateLimited)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func registerMetrics(source *api.CachedSource, dispatcher *outbound.Dispatcher, subs *subscriptions.Subscriptions) {
+	metrics.CounterFunc("train_cache_hits_total", "Train lookups answered from the cache.", func() float64 {
+		return float64(source.Stats().Hits)
+	})
+	metrics.CounterFunc("train_cache_coalesced_total", "Train lookups that waited for an identical lookup in progress.", func() float64 {
+		return float64(source.Stats().Coalesced)
+	})
+	metrics.CounterFunc("train_cache_misses_total", "Train lookups that were sent to the API.", func() float64 {
+		return float64(source.Stats().Misses)
+	})
+	metrics.CounterFunc("telegram_requests_sent_total", "Telegram API requests that succeeded.", func() float64 {
+		return float64(dispatcher.Stats().Sent)
+	})
+	metrics.CounterFunc("telegram_requests_failed_total", "Telegram API requests that failed.", func() float64 {
+		return float64(dispatcher.Stats().Failed)
+	})
+	metrics.GaugeFunc("telegram_queue_depth", "Telegram API requests waiting to be sent.", func() float64 {
+		return float64(dispatcher.Stats().Queued)
+	})
+	metrics.GaugeFunc("active_subscriptions", "Tracked messages that are kept up to date.", func() float64 {
+		return float64(subs.Count())
+	})
+}
+
+// serveHttp serves handler on addr until ctx is done.
+func serveHttp(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Serving HTTP", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server error", logging.Err(err))
+	}
+}
+
+// webhookHandler only passes on requests carrying the secret token given to
+// Telegram, since the bot library doesn't check it.
+func webhookHandler(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			slog.Warn("Rejected webhook request with a wrong secret token", "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		health.MarkTelegramUpdate()
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func randomSecret() string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
 		panic(err)
 	}
+	return hex.EncodeToString(secret)
+}
 
-	log.Print("INFO : Starting...")
-	bot.Start(ctx)
+// messageCommand returns the command a message starts with, for the updates
+// metric.
+func messageCommand(text string) string {
+	for _, command := range []string{trainInfoCommand, stationInfoCommand, routeCommand, commutesCommand, subscriptionsCommand, cancelCommand} {
+		if strings.HasPrefix(text, command) {
+			return command
+		}
+	}
+	return "text"
 }
 
-func handlerBuilder(subs *subscriptions.Subscriptions) func(context.Context, *tgBot.Bot, *models.Update) {
-	return func(ctx context.Context, b *tgBot.Bot, update *models.Update) {
-		handler(ctx, b, update, subs)
+func handlerBuilder(sender *outbound.Sender, chatFlows *handlers.ChatFlowStore, source api.TrainDataSource, subs *subscriptions.Subscriptions, stations *api.StationIndex, gracePeriod time.Duration) func(context.Context, *tgBot.Bot, *models.Update) {
+	return func(ctx context.Context, _ *tgBot.Bot, update *models.Update) {
+		handler(ctx, chatFlows, sender, update, source, subs, stations, gracePeriod)
 	}
 }
 
-func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *subscriptions.Subscriptions) {
+// gracePeriod is how long after its arrival a train may still be tracked, see
+// subscriptions.PollingConfig.
+func handler(ctx context.Context, chatFlows *handlers.ChatFlowStore, b *outbound.Sender, update *models.Update, source api.TrainDataSource, subs *subscriptions.Subscriptions, stations *api.StationIndex, gracePeriod time.Duration) {
+	ctx = logging.With(ctx, logging.UpdateIdKey, update.ID)
+	updateType, command := "other", ""
+	defer func() {
+		metrics.UpdatesHandled.WithLabelValues(updateType, command).Inc()
+	}()
 	var response *handlers.HandlerResponse
 	var toEditId int
 	defer func() {
@@ -133,6 +506,9 @@ func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *sub
 		if response.CallbackAnswer != nil {
 			b.AnswerCallbackQuery(ctx, response.CallbackAnswer)
 		}
+		if response.InlineQueryAnswer != nil {
+			b.AnswerInlineQuery(ctx, response.InlineQueryAnswer)
+		}
 		for _, edit := range response.MessageEdits {
 			if (edit.ChatID == nil || edit.MessageID == 0) && edit.InlineMessageID == "" {
 				edit.ChatID = response.Injected.ChatId
@@ -157,21 +533,40 @@ func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *sub
 			response.Injected.ChatId = update.Message.Chat.ID
 			response.Injected.MessageId = update.Message.ID
 		}()
-		log.Printf("DEBUG: Got message: %s\n", update.Message.Text)
+		ctx = logging.With(ctx, logging.ChatIdKey, update.Message.Chat.ID)
+		updateType, command = "message", messageCommand(update.Message.Text)
+		logging.FromContext(ctx).Debug("Got message", logging.MessageText(update.Message.Text))
 
-		chatFlow := handlers.GetChatFlow(update.Message.Chat.ID)
+		chatFlow := chatFlows.Get(ctx, update.Message.Chat.ID)
 
 		switch {
 		case strings.HasPrefix(update.Message.Text, trainInfoCommand):
-			response = handleFindTrainStages(ctx, b, update)
+			response = handleFindTrainStages(ctx, chatFlows, b, update, source, gracePeriod)
+		case strings.HasPrefix(update.Message.Text, stationInfoCommand):
+			response = handleStationInfoStages(ctx, chatFlows, b, update, source, stations)
+		case strings.HasPrefix(update.Message.Text, routeCommand):
+			response = handleRouteStages(ctx, chatFlows, b, update, source, stations)
+		case strings.HasPrefix(update.Message.Text, commutesCommand):
+			response = handleCommuteStages(ctx, chatFlows, update, source, subs)
+		case strings.HasPrefix(update.Message.Text, subscriptionsCommand):
+			chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+			message, err := b.SendMessage(ctx, &tgBot.SendMessageParams{
+				ChatID: update.Message.Chat.ID,
+				Text:   pleaseWaitMessage,
+			})
+			response = subs.GetSubscriptionsListResponse(ctx, subs.GetChatSubscriptions(update.Message.Chat.ID), 0)
+			if err == nil {
+				response.ProgressMessageToEditId = message.ID
+			}
 		case strings.HasPrefix(update.Message.Text, cancelCommand):
-			handlers.SetChatFlow(chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+			chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
 			response = &handlers.HandlerResponse{
 				Message: &tgBot.SendMessageParams{
 					Text: cancelResponseMessage,
 				},
 			}
 		default:
+			logging.FromContext(ctx).Debug("Continuing chat flow", "type", chatFlow.Type, "stage", chatFlow.Stage)
 			switch chatFlow.Type {
 			case handlers.InitialFlowType:
 				b.SendMessage(ctx, &tgBot.SendMessageParams{
@@ -179,12 +574,45 @@ func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *sub
 					Text:   initialMessage,
 				})
 			case handlers.TrainInfoFlowType:
-				log.Printf("DEBUG: trainInfoFlowType with stage %s\n", chatFlow.Stage)
-				response = handleFindTrainStages(ctx, b, update)
+				response = handleFindTrainStages(ctx, chatFlows, b, update, source, gracePeriod)
+			case handlers.StationInfoFlowType:
+				response = handleStationInfoStages(ctx, chatFlows, b, update, source, stations)
+			case handlers.RouteFlowType:
+				response = handleRouteStages(ctx, chatFlows, b, update, source, stations)
+			case handlers.CommuteFlowType:
+				response = handleCommuteStages(ctx, chatFlows, update, source, subs)
 			}
 		}
 	}
-	if update.CallbackQuery != nil {
+	if update.InlineQuery != nil {
+		logging.FromContext(ctx).Debug("Got inline query", logging.MessageText(update.InlineQuery.Query))
+		updateType = "inline_query"
+		response = handlers.HandleTrainInlineQuery(ctx, source, update.InlineQuery.Query, gracePeriod)
+		response.InlineQueryAnswer.InlineQueryID = update.InlineQuery.ID
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.Message == nil {
+		// Messages sent via inline mode don't belong to a chat the bot is in,
+		// so only the subscription buttons are available
+		ref := subscriptions.MessageRef{
+			InlineMessageId: update.CallbackQuery.InlineMessageID,
+		}
+		splitted := strings.Split(update.CallbackQuery.Data, "\x1b")
+		updateType, command = "inline_callback_query", splitted[0]
+		switch splitted[0] {
+		case handlers.TrainInfoSubscribeCallbackQuery:
+			response = handleSubscribeCallback(ctx, subs, ref, splitted)
+		case handlers.TrainInfoUnsubscribeCallbackQuery:
+			response = handleUnsubscribeCallback(ctx, subs, ref, splitted)
+		default:
+			logging.FromContext(ctx).Warn("Unknown inline message callback query method", "method", splitted[0])
+			command = "unknown"
+			response = &handlers.HandlerResponse{}
+		}
+		if response.CallbackAnswer == nil {
+			response.CallbackAnswer = &tgBot.AnswerCallbackQueryParams{}
+		}
+		response.CallbackAnswer.CallbackQueryID = update.CallbackQuery.ID
+	} else if update.CallbackQuery != nil {
 		defer func() {
 			if response == nil {
 				response = &handlers.HandlerResponse{
@@ -205,10 +633,14 @@ func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *sub
 			}
 		}()
 
-		chatFlow := handlers.GetChatFlow(update.CallbackQuery.Message.Chat.ID)
+		ctx = logging.With(ctx, logging.ChatIdKey, update.CallbackQuery.Message.Chat.ID)
+		logging.FromContext(ctx).Debug("Got callback query", "method", strings.SplitN(update.CallbackQuery.Data, "\x1b", 2)[0])
+		chatFlow := chatFlows.Get(ctx, update.CallbackQuery.Message.Chat.ID)
 
+		updateType = "callback_query"
 		if len(update.CallbackQuery.Data) != 0 {
 			splitted := strings.Split(update.CallbackQuery.Data, "\x1b")
+			command = splitted[0]
 			switch splitted[0] {
 			case handlers.TrainInfoChooseDateCallbackQuery:
 				trainNumber := splitted[1]
@@ -218,18 +650,39 @@ func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *sub
 					ChatID: update.CallbackQuery.Message.Chat.ID,
 					Text:   pleaseWaitMessage,
 				})
-				response, _ = handlers.HandleTrainNumberCommand(ctx, trainNumber, date, -1, false)
+				response, _ = handlers.HandleTrainNumberCommand(ctx, source, trainNumber, date, -1, false, gracePeriod)
 				if err == nil {
 					response.ProgressMessageToEditId = message.ID
 				}
-				handlers.SetChatFlow(chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+				chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+
+			case handlers.RouteTrainCallbackQuery:
+				trainNumber := splitted[1]
+				departureInt, _ := strconv.ParseInt(splitted[2], 10, 64)
+				message, err := b.SendMessage(ctx, &tgBot.SendMessageParams{
+					ChatID: update.CallbackQuery.Message.Chat.ID,
+					Text:   pleaseWaitMessage,
+				})
+				response, _ = handlers.HandleRouteTrainCommand(ctx, source, trainNumber, time.Unix(departureInt, 0), gracePeriod)
+				if response == nil {
+					// Network errors have no message of their own
+					response = &handlers.HandlerResponse{
+						Message: &tgBot.SendMessageParams{
+							Text: fmt.Sprintf(trainLookupFailedMessage, trainNumber),
+						},
+					}
+				}
+				if err == nil {
+					response.ProgressMessageToEditId = message.ID
+				}
+				chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
 
 			case handlers.TrainInfoChooseGroupCallbackQuery:
 				trainNumber := splitted[1]
 				dateInt, _ := strconv.ParseInt(splitted[2], 10, 64)
 				date := time.Unix(dateInt, 0)
 				groupIndex, _ := strconv.ParseInt(splitted[3], 10, 31)
-				originalResponse, _ := handlers.HandleTrainNumberCommand(ctx, trainNumber, date, int(groupIndex), false)
+				originalResponse, _ := handlers.HandleTrainNumberCommand(ctx, source, trainNumber, date, int(groupIndex), false, gracePeriod)
 				response = &handlers.HandlerResponse{
 					MessageEdits: []*tgBot.EditMessageTextParams{
 						{
@@ -242,81 +695,373 @@ func handler(ctx context.Context, b *tgBot.Bot, update *models.Update, subs *sub
 					},
 				}
 
-			case handlers.TrainInfoSubscribeCallbackQuery:
+			case handlers.TrainInfoTimetableCallbackQuery:
 				trainNumber := splitted[1]
 				dateInt, _ := strconv.ParseInt(splitted[2], 10, 64)
 				date := time.Unix(dateInt, 0)
-				groupIndex, _ := strconv.ParseInt(splitted[3], 10, 31)
-				err := subs.InsertSubscription(subscriptions.SubData{
-					ChatId:      update.CallbackQuery.Message.Chat.ID,
-					MessageId:   update.CallbackQuery.Message.ID,
-					TrainNumber: trainNumber,
-					Date:        date,
-					GroupIndex:  int(groupIndex),
+				groupIndex, _ := strconv.Atoi(splitted[3])
+				if len(splitted) < 5 {
+					// Pressed below the train information, show the timetable as a new message
+					response, _ = handlers.HandleTrainTimetableCommand(ctx, source, trainNumber, date, groupIndex, -1)
+					break
+				}
+				page, _ := strconv.Atoi(splitted[4])
+				pageResponse, ok := handlers.HandleTrainTimetableCommand(ctx, source, trainNumber, date, groupIndex, page)
+				if !ok {
+					response = &handlers.HandlerResponse{
+						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+							Text:      pageResponse.Message.Text,
+							ShowAlert: true,
+						},
+					}
+					break
+				}
+				response = &handlers.HandlerResponse{
+					MessageEdits: []*tgBot.EditMessageTextParams{
+						{
+							Text:        pageResponse.Message.Text,
+							Entities:    pageResponse.Message.Entities,
+							ReplyMarkup: pageResponse.Message.ReplyMarkup,
+						},
+					},
+				}
+
+			case handlers.TrainInfoSubscribeCallbackQuery:
+				response = handleSubscribeCallback(ctx, subs, subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: update.CallbackQuery.Message.ID,
+				}, splitted)
+
+			case handlers.TrainInfoUnsubscribeCallbackQuery:
+				response = handleUnsubscribeCallback(ctx, subs, subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: update.CallbackQuery.Message.ID,
+				}, splitted)
+
+			case handlers.TrainInfoNotificationsCallbackQuery:
+				data, ok := subs.GetSubscription(subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: update.CallbackQuery.Message.ID,
 				})
-				if err != nil {
-					log.Printf("ERROR: Subscribe error: %s", err.Error())
+				if !ok {
 					response = &handlers.HandlerResponse{
 						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
-							Text:      fmt.Sprintf("Error when subscribing."),
+							Text:      "You are not subscribed to this message.",
 							ShowAlert: true,
 						},
 					}
-				} else {
-					log.Printf("DEBUG: Subscribed: chatID %d, trainNumber %s, date %s, groupIndex %d", update.CallbackQuery.Message.Chat.ID, trainNumber, date.Format("2006-01-02"), groupIndex)
+					break
+				}
+				response = subscriptions.GetNotificationSettingsResponse(data)
+
+			case handlers.TrainInfoNotificationSetCallbackQuery:
+				messageId, _ := strconv.Atoi(splitted[1])
+				ref := subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: messageId,
+				}
+				data, ok := subs.GetSubscription(ref)
+				if !ok {
 					response = &handlers.HandlerResponse{
 						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
-							Text: fmt.Sprintf("Subscribed successfully!"),
+							Text:      "You are no longer subscribed to this train.",
+							ShowAlert: true,
 						},
-						MessageMarkupEdits: []*tgBot.EditMessageReplyMarkupParams{
-							{
-								ChatID:      update.CallbackQuery.Message.Chat.ID,
-								MessageID:   update.CallbackQuery.Message.ID,
-								ReplyMarkup: handlers.GetTrainNumberCommandResponseButtons(trainNumber, date, int(groupIndex), handlers.TrainInfoResponseButtonIncludeUnsub),
-							},
+					}
+					break
+				}
+				rules := data.Notify
+				rules.Toggle(splitted[2])
+				data, err := subs.UpdateNotificationRules(ref, rules)
+				if err != nil {
+					logging.FromContext(ctx).Error("Notification settings error", logging.Err(err))
+					response = &handlers.HandlerResponse{
+						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+							Text:      "Error when saving the notification settings.",
+							ShowAlert: true,
 						},
 					}
+					break
+				}
+				settings := subscriptions.GetNotificationSettingsResponse(data)
+				response = &handlers.HandlerResponse{
+					MessageMarkupEdits: []*tgBot.EditMessageReplyMarkupParams{
+						{
+							ReplyMarkup: settings.Message.ReplyMarkup,
+						},
+					},
 				}
 
-			case handlers.TrainInfoUnsubscribeCallbackQuery:
-				trainNumber := splitted[1]
-				dateInt, _ := strconv.ParseInt(splitted[2], 10, 64)
+			case handlers.TrainInfoStopsCallbackQuery:
+				data, ok := subs.GetSubscription(subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: update.CallbackQuery.Message.ID,
+				})
+				if !ok {
+					response = &handlers.HandlerResponse{
+						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+							Text:      "You are not subscribed to this message.",
+							ShowAlert: true,
+						},
+					}
+					break
+				}
+				response = subs.GetStopsPickerResponse(ctx, data)
+
+			case handlers.TrainInfoChooseFromCallbackQuery, handlers.TrainInfoChooseToCallbackQuery:
+				messageId, _ := strconv.Atoi(splitted[1])
+				stationIdx, _ := strconv.Atoi(splitted[2])
+				response = subs.HandleStopsCallback(ctx, subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: messageId,
+				}, splitted[0], stationIdx, gracePeriod)
+
+			case handlers.TrainInfoStopsPageCallbackQuery:
+				messageId, _ := strconv.Atoi(splitted[2])
+				firstIdx, _ := strconv.Atoi(splitted[3])
+				page, _ := strconv.Atoi(splitted[4])
+				response = subs.HandleStopsPageCallback(ctx, subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: messageId,
+				}, splitted[1], firstIdx, page)
+
+			case handlers.StationInfoChooseKindCallbackQuery:
+				stationName := splitted[1]
+				kind := splitted[2]
+				response = getStationInfoChooseWindowResponse(stationName, kind)
+				chatFlows.Set(ctx, chatFlow, handlers.StationInfoFlowType, handlers.WaitingForStationWindowStage, stationName+"\x1b"+kind)
+
+			case handlers.StationInfoChooseWindowCallbackQuery:
+				stationName := splitted[1]
+				kind := splitted[2]
+				fromInt, _ := strconv.ParseInt(splitted[3], 10, 64)
+				from := time.Unix(fromInt, 0)
+				minutes, _ := strconv.ParseInt(splitted[4], 10, 64)
+				until := from.Add(time.Minute * time.Duration(minutes))
+				message, err := b.SendMessage(ctx, &tgBot.SendMessageParams{
+					ChatID: update.CallbackQuery.Message.Chat.ID,
+					Text:   pleaseWaitMessage,
+				})
+				response, _ = handlers.HandleStationInfoCommand(ctx, source, stationName, kind, from, until)
+				if err == nil && response != nil {
+					response.ProgressMessageToEditId = message.ID
+				}
+				chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+
+			case handlers.StationPickCallbackQuery:
+				if station, ok := stations.GetByLinkName(splitted[1]); ok {
+					response = continueWithStation(ctx, chatFlows, chatFlow, station)
+				}
+
+			case handlers.RouteChooseDateCallbackQuery:
+				dateInt, _ := strconv.ParseInt(splitted[1], 10, 64)
 				date := time.Unix(dateInt, 0)
-				groupIndex, _ := strconv.ParseInt(splitted[3], 10, 31)
-				_, err := subs.DeleteSubscription(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.ID)
+				response = executeRouteSearch(ctx, chatFlows, b, source, stations, update.CallbackQuery.Message.Chat.ID, chatFlow, date)
+
+			case handlers.CommuteAddCallbackQuery:
+				chatFlows.Set(ctx, chatFlow, handlers.CommuteFlowType, handlers.WaitingForTrainNumberStage, "")
+				response = &handlers.HandlerResponse{
+					Message: &tgBot.SendMessageParams{
+						Text: waitingForCommuteTrainMessage,
+					},
+				}
+
+			case handlers.CommutePauseCallbackQuery, handlers.CommuteDeleteCallbackQuery:
+				chatId := update.CallbackQuery.Message.Chat.ID
+				commuteId, _ := strconv.ParseUint(splitted[1], 10, 64)
+				var err error
+				if splitted[0] == handlers.CommutePauseCallbackQuery {
+					err = subs.ToggleCommutePaused(chatId, uint(commuteId))
+				} else {
+					err = subs.DeleteCommute(chatId, uint(commuteId))
+				}
 				if err != nil {
-					log.Printf("ERROR: Unsubscribe error: %s", err.Error())
+					logging.FromContext(ctx).Error("Commute error", logging.Err(err), "commute_id", commuteId)
 					response = &handlers.HandlerResponse{
 						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
-							Text:      fmt.Sprintf("Error when unsubscribing."),
+							Text:      "Error when updating the commute.",
 							ShowAlert: true,
 						},
 					}
-				} else {
-					log.Printf("DEBUG: Unsubscribed: chatID %d, trainNumber %s, date %s, groupIndex %d", update.CallbackQuery.Message.Chat.ID, trainNumber, date.Format("2006-01-02"), groupIndex)
+					break
+				}
+				list := subscriptions.GetCommutesResponse(subs.GetChatCommutes(chatId))
+				response = &handlers.HandlerResponse{
+					MessageEdits: []*tgBot.EditMessageTextParams{
+						{
+							Text:        list.Message.Text,
+							ReplyMarkup: list.Message.ReplyMarkup,
+						},
+					},
+				}
+
+			case handlers.CommuteChooseGroupCallbackQuery:
+				if chatFlow.Type != handlers.CommuteFlowType || chatFlow.Stage != handlers.WaitingForCommuteGroupStage {
+					break
+				}
+				groupIndex, _ := strconv.Atoi(splitted[1])
+				response = chooseCommuteGroup(ctx, chatFlows, source, chatFlow, chatFlow.Extra, groupIndex)
+
+			case handlers.CommuteChooseDaysCallbackQuery:
+				if chatFlow.Type != handlers.CommuteFlowType || chatFlow.Stage != handlers.WaitingForCommuteDaysStage {
+					break
+				}
+				mask, _ := strconv.ParseUint(splitted[1], 10, 8)
+				response = chooseCommuteDays(ctx, chatFlows, chatFlow, uint8(mask))
+
+			case handlers.SubscriptionsUnsubscribeCallbackQuery:
+				messageId, _ := strconv.Atoi(splitted[1])
+				// Lists sent before they had pages don't carry one
+				page := 0
+				if len(splitted) > 2 {
+					page, _ = strconv.Atoi(splitted[2])
+				}
+				deletedSub, err := subs.DeleteSubscription(subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: messageId,
+				})
+				if err != nil {
+					logging.FromContext(ctx).Error("Unsubscribe error", logging.Err(err))
 					response = &handlers.HandlerResponse{
 						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
-							Text: fmt.Sprintf("Unsubscribed successfully!"),
+							Text:      "Error when unsubscribing.",
+							ShowAlert: true,
 						},
-						MessageMarkupEdits: []*tgBot.EditMessageReplyMarkupParams{
-							{
-								ChatID:      update.CallbackQuery.Message.Chat.ID,
-								MessageID:   update.CallbackQuery.Message.ID,
-								ReplyMarkup: handlers.GetTrainNumberCommandResponseButtons(trainNumber, date, int(groupIndex), handlers.TrainInfoResponseButtonIncludeSub),
-							},
+					}
+					break
+				}
+				response = getSubscriptionsListEditResponse(ctx, subs, update.CallbackQuery.Message.Chat.ID, []subscriptions.SubData{*deletedSub}, page)
+
+			case handlers.SubscriptionsUnsubscribeAllCallbackQuery:
+				chatId := update.CallbackQuery.Message.Chat.ID
+				deletedSubs := subs.GetChatSubscriptions(chatId)
+				if err := subs.DeleteChat(chatId); err != nil {
+					logging.FromContext(ctx).Error("Unsubscribe error", logging.Err(err))
+					response = &handlers.HandlerResponse{
+						CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+							Text:      "Error when unsubscribing.",
+							ShowAlert: true,
 						},
 					}
+					break
 				}
+				response = getSubscriptionsListEditResponse(ctx, subs, chatId, deletedSubs, 0)
+
+			case handlers.SubscriptionsPageCallbackQuery:
+				page, _ := strconv.Atoi(splitted[1])
+				list := subs.GetSubscriptionsListResponse(ctx, subs.GetChatSubscriptions(update.CallbackQuery.Message.Chat.ID), page)
+				response = &handlers.HandlerResponse{
+					MessageEdits: []*tgBot.EditMessageTextParams{
+						{
+							Text:                  list.Message.Text,
+							Entities:              list.Message.Entities,
+							DisableWebPagePreview: list.Message.DisableWebPagePreview,
+							ReplyMarkup:           list.Message.ReplyMarkup,
+						},
+					},
+				}
+
+			case handlers.SubscriptionsShowCallbackQuery:
+				messageId, _ := strconv.Atoi(splitted[1])
+				response = subs.HandleShowCallback(subscriptions.MessageRef{
+					ChatId:    update.CallbackQuery.Message.Chat.ID,
+					MessageId: messageId,
+				})
 
 			default:
-				log.Printf("WARN : Unknown callback query method: %s", splitted[0])
+				logging.FromContext(ctx).Warn("Unknown callback query method", "method", splitted[0])
+				command = "unknown"
 			}
 		}
 	}
 }
 
-func handleFindTrainStages(ctx context.Context, b *tgBot.Bot, update *models.Update) *handlers.HandlerResponse {
-	log.Println("DEBUG: handleFindTrainStages")
+// getSubscriptionsListEditResponse refreshes the subscriptions list after
+// unsubscribing, staying on the given page, and removes the unsubscribe buttons
+// from the tracked messages.
+func getSubscriptionsListEditResponse(ctx context.Context, subs *subscriptions.Subscriptions, chatId int64, deletedSubs []subscriptions.SubData, page int) *handlers.HandlerResponse {
+	list := subs.GetSubscriptionsListResponse(ctx, subs.GetChatSubscriptions(chatId), page)
+	response := &handlers.HandlerResponse{
+		CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+			Text: "Unsubscribed successfully!",
+		},
+		MessageEdits: []*tgBot.EditMessageTextParams{
+			{
+				Text:                  list.Message.Text,
+				Entities:              list.Message.Entities,
+				DisableWebPagePreview: list.Message.DisableWebPagePreview,
+				ReplyMarkup:           list.Message.ReplyMarkup,
+			},
+		},
+	}
+	for _, deletedSub := range deletedSubs {
+		response.MessageMarkupEdits = append(response.MessageMarkupEdits, deletedSub.Ref().EditMarkupParams(
+			handlers.GetTrainNumberCommandResponseButtons(deletedSub.TrainNumber, deletedSub.Date, deletedSub.GroupIndex, handlers.TrainInfoResponseButtonExcludeSub),
+		))
+	}
+	return response
+}
+
+func handleSubscribeCallback(ctx context.Context, subs *subscriptions.Subscriptions, ref subscriptions.MessageRef, splitted []string) *handlers.HandlerResponse {
+	trainNumber := splitted[1]
+	dateInt, _ := strconv.ParseInt(splitted[2], 10, 64)
+	date := time.Unix(dateInt, 0)
+	groupIndex, _ := strconv.ParseInt(splitted[3], 10, 31)
+	err := subs.InsertSubscription(subscriptions.SubData{
+		ChatId:          ref.ChatId,
+		MessageId:       ref.MessageId,
+		InlineMessageId: ref.InlineMessageId,
+		TrainNumber:     trainNumber,
+		Date:            date,
+		GroupIndex:      int(groupIndex),
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Subscribe error", logging.Err(err), logging.TrainNumberKey, trainNumber)
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+				Text:      fmt.Sprintf("Error when subscribing."),
+				ShowAlert: true,
+			},
+		}
+	}
+	logging.FromContext(ctx).Debug("Subscribed", "ref", ref.String(), logging.TrainNumberKey, trainNumber, "date", date.Format("2006-01-02"), "group_index", groupIndex)
+	return &handlers.HandlerResponse{
+		CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+			Text: fmt.Sprintf("Subscribed successfully!"),
+		},
+		MessageMarkupEdits: []*tgBot.EditMessageReplyMarkupParams{
+			ref.EditMarkupParams(handlers.GetTrainNumberCommandResponseButtons(trainNumber, date, int(groupIndex), handlers.TrainInfoResponseButtonIncludeUnsub)),
+		},
+	}
+}
+
+func handleUnsubscribeCallback(ctx context.Context, subs *subscriptions.Subscriptions, ref subscriptions.MessageRef, splitted []string) *handlers.HandlerResponse {
+	trainNumber := splitted[1]
+	dateInt, _ := strconv.ParseInt(splitted[2], 10, 64)
+	date := time.Unix(dateInt, 0)
+	groupIndex, _ := strconv.ParseInt(splitted[3], 10, 31)
+	_, err := subs.DeleteSubscription(ref)
+	if err != nil {
+		logging.FromContext(ctx).Error("Unsubscribe error", logging.Err(err), logging.TrainNumberKey, trainNumber)
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+				Text:      fmt.Sprintf("Error when unsubscribing."),
+				ShowAlert: true,
+			},
+		}
+	}
+	logging.FromContext(ctx).Debug("Unsubscribed", "ref", ref.String(), logging.TrainNumberKey, trainNumber, "date", date.Format("2006-01-02"), "group_index", groupIndex)
+	return &handlers.HandlerResponse{
+		CallbackAnswer: &tgBot.AnswerCallbackQueryParams{
+			Text: fmt.Sprintf("Unsubscribed successfully!"),
+		},
+		MessageMarkupEdits: []*tgBot.EditMessageReplyMarkupParams{
+			ref.EditMarkupParams(handlers.GetTrainNumberCommandResponseButtons(trainNumber, date, int(groupIndex), handlers.TrainInfoResponseButtonIncludeSub)),
+		},
+	}
+}
+
+func handleFindTrainStages(ctx context.Context, chatFlows *handlers.ChatFlowStore, b *outbound.Sender, update *models.Update, source api.TrainDataSource, gracePeriod time.Duration) *handlers.HandlerResponse {
 	var response *handlers.HandlerResponse
 
 	var chatId int64
@@ -326,7 +1071,7 @@ func handleFindTrainStages(ctx context.Context, b *tgBot.Bot, update *models.Upd
 	if update.CallbackQuery != nil {
 		chatId = update.CallbackQuery.Message.Chat.ID
 	}
-	chatFlow := handlers.GetChatFlow(chatId)
+	chatFlow := chatFlows.Get(ctx, chatId)
 	switch chatFlow.Type {
 	case handlers.InitialFlowType:
 		// Only command is possible here
@@ -349,7 +1094,7 @@ func handleFindTrainStages(ctx context.Context, b *tgBot.Bot, update *models.Upd
 				groupIndex, _ = strconv.Atoi(commandParams[2])
 			}
 
-			response, _ = handlers.HandleTrainNumberCommand(ctx, trainNumber, date, groupIndex, false)
+			response, _ = handlers.HandleTrainNumberCommand(ctx, source, trainNumber, date, groupIndex, false, gracePeriod)
 			if err == nil {
 				response.ProgressMessageToEditId = message.ID
 			}
@@ -357,21 +1102,21 @@ func handleFindTrainStages(ctx context.Context, b *tgBot.Bot, update *models.Upd
 			// Got only train number
 			trainNumber := commandParams[0]
 			response = getTrainInfoChooseDateResponse(trainNumber)
-			handlers.SetChatFlow(chatFlow, handlers.TrainInfoFlowType, handlers.WaitingForDateStage, trainNumber)
+			chatFlows.Set(ctx, chatFlow, handlers.TrainInfoFlowType, handlers.WaitingForDateStage, trainNumber)
 		} else {
 			response = &handlers.HandlerResponse{
 				Message: &tgBot.SendMessageParams{
 					Text: waitingForTrainNumberMessage,
 				},
 			}
-			handlers.SetChatFlow(chatFlow, handlers.TrainInfoFlowType, handlers.WaitingForTrainNumberStage, "")
+			chatFlows.Set(ctx, chatFlow, handlers.TrainInfoFlowType, handlers.WaitingForTrainNumberStage, "")
 		}
 	case handlers.TrainInfoFlowType:
 		switch chatFlow.Stage {
 		case handlers.WaitingForTrainNumberStage:
 			trainNumber := update.Message.Text
 			response = getTrainInfoChooseDateResponse(trainNumber)
-			handlers.SetChatFlow(chatFlow, handlers.TrainInfoFlowType, handlers.WaitingForDateStage, trainNumber)
+			chatFlows.Set(ctx, chatFlow, handlers.TrainInfoFlowType, handlers.WaitingForDateStage, trainNumber)
 		case handlers.WaitingForDateStage:
 			date, err := utils.ParseDate(update.Message.Text)
 			if err != nil {
@@ -385,11 +1130,11 @@ func handleFindTrainStages(ctx context.Context, b *tgBot.Bot, update *models.Upd
 					ChatID: update.Message.Chat.ID,
 					Text:   pleaseWaitMessage,
 				})
-				response, _ = handlers.HandleTrainNumberCommand(ctx, chatFlow.Extra, date, -1, false)
+				response, _ = handlers.HandleTrainNumberCommand(ctx, source, chatFlow.Extra, date, -1, false, gracePeriod)
 				if err == nil {
 					response.ProgressMessageToEditId = message.ID
 				}
-				handlers.SetChatFlow(chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+				chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
 			}
 		}
 	}
@@ -397,14 +1142,25 @@ func handleFindTrainStages(ctx context.Context, b *tgBot.Bot, update *models.Upd
 }
 
 func getTrainInfoChooseDateResponse(trainNumber string) *handlers.HandlerResponse {
+	return &handlers.HandlerResponse{
+		Message: &tgBot.SendMessageParams{
+			Text: chooseDateMessage,
+			ReplyMarkup: getChooseDateKeyboard(func(date time.Time) string {
+				return fmt.Sprintf(handlers.TrainInfoChooseDateCallbackQuery+"\x1b%s\x1b%d", trainNumber, date.Unix())
+			}),
+		},
+	}
+}
+
+func getChooseDateKeyboard(callbackData func(date time.Time) string) models.InlineKeyboardMarkup {
 	replyButtons := make([][]models.InlineKeyboardButton, 0, 4)
 	replyButtons = append(replyButtons, []models.InlineKeyboardButton{
 		{
 			Text:         fmt.Sprintf("Yesterday (%s)", time.Now().Add(time.Hour*-24).In(utils.Location).Format("02.01.2006")),
-			CallbackData: fmt.Sprintf(handlers.TrainInfoChooseDateCallbackQuery+"\x1b%s\x1b%d", trainNumber, time.Now().Add(time.Hour*-24).Unix()),
+			CallbackData: callbackData(time.Now().Add(time.Hour * -24)),
 		}, {
 			Text:         fmt.Sprintf("Today (%s)", time.Now().In(utils.Location).Format("02.01.2006")),
-			CallbackData: fmt.Sprintf(handlers.TrainInfoChooseDateCallbackQuery+"\x1b%s\x1b%d", trainNumber, time.Now().Unix()),
+			CallbackData: callbackData(time.Now()),
 		},
 	})
 	for i := 1; i < 4; i++ {
@@ -413,17 +1169,330 @@ func getTrainInfoChooseDateResponse(trainNumber string) *handlers.HandlerRespons
 			ts := time.Now().Add(time.Hour * time.Duration(24*(j+(i-1)*7+1))).In(utils.Location)
 			arr = append(arr, models.InlineKeyboardButton{
 				Text:         ts.Format("02.01"),
-				CallbackData: fmt.Sprintf(handlers.TrainInfoChooseDateCallbackQuery+"\x1b%s\x1b%d", trainNumber, ts.Unix()),
+				CallbackData: callbackData(ts),
 			})
 		}
 		replyButtons = append(replyButtons, arr)
 	}
+	return models.InlineKeyboardMarkup{
+		InlineKeyboard: replyButtons,
+	}
+}
+
+func handleStationInfoStages(ctx context.Context, chatFlows *handlers.ChatFlowStore, b *outbound.Sender, update *models.Update, source api.TrainDataSource, stations *api.StationIndex) *handlers.HandlerResponse {
+	var response *handlers.HandlerResponse
+
+	chatFlow := chatFlows.Get(ctx, update.Message.Chat.ID)
+	if strings.HasPrefix(update.Message.Text, stationInfoCommand) {
+		// A new command always restarts the flow
+		stationName := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, stationInfoCommand))
+		chatFlows.Set(ctx, chatFlow, handlers.StationInfoFlowType, handlers.WaitingForStationNameStage, "")
+		if len(stationName) != 0 {
+			response = handleStationInput(ctx, chatFlows, chatFlow, stations, stationName)
+		} else {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: waitingForStationNameMessage,
+				},
+			}
+		}
+		return response
+	}
+
+	switch chatFlow.Stage {
+	case handlers.WaitingForStationNameStage:
+		response = handleStationInput(ctx, chatFlows, chatFlow, stations, update.Message.Text)
+	case handlers.WaitingForStationKindStage:
+		var kind string
+		switch strings.ToLower(strings.TrimSpace(update.Message.Text)) {
+		case strings.ToLower(arrivalsButton):
+			kind = handlers.StationInfoArrivals
+		case strings.ToLower(departuresButton):
+			kind = handlers.StationInfoDepartures
+		default:
+			return &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: invalidStationKindMessage,
+				},
+			}
+		}
+		response = getStationInfoChooseWindowResponse(chatFlow.Extra, kind)
+		chatFlows.Set(ctx, chatFlow, handlers.StationInfoFlowType, handlers.WaitingForStationWindowStage, chatFlow.Extra+"\x1b"+kind)
+	case handlers.WaitingForStationWindowStage:
+		extra := strings.Split(chatFlow.Extra, "\x1b")
+		date, err := utils.ParseDate(update.Message.Text)
+		if err != nil || len(extra) != 2 {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: invalidDateMessage,
+				},
+			}
+		} else {
+			message, err := b.SendMessage(ctx, &tgBot.SendMessageParams{
+				ChatID: update.Message.Chat.ID,
+				Text:   pleaseWaitMessage,
+			})
+			date = date.In(utils.Location)
+			from := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, utils.Location)
+			response, _ = handlers.HandleStationInfoCommand(ctx, source, extra[0], extra[1], from, from.AddDate(0, 0, 1))
+			if err == nil && response != nil {
+				response.ProgressMessageToEditId = message.ID
+			}
+			chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+		}
+	}
+	return response
+}
+
+// handleStationInput resolves a station typed by the user and advances the
+// current flow, or asks the user to pick among similarly named stations.
+func handleStationInput(ctx context.Context, chatFlows *handlers.ChatFlowStore, chatFlow *handlers.ChatFlow, stations *api.StationIndex, input string) *handlers.HandlerResponse {
+	station, response := handlers.ResolveStation(ctx, stations, input)
+	if response != nil {
+		return response
+	}
+	return continueWithStation(ctx, chatFlows, chatFlow, station)
+}
+
+// continueWithStation advances the current flow with the chosen station. The
+// flow keeps the station's link name, for the requests to the scraper.
+func continueWithStation(ctx context.Context, chatFlows *handlers.ChatFlowStore, chatFlow *handlers.ChatFlow, station *api.IndexedStation) *handlers.HandlerResponse {
+	stationName := station.LinkName
+	switch {
+	case chatFlow.Type == handlers.StationInfoFlowType && chatFlow.Stage == handlers.WaitingForStationNameStage:
+		chatFlows.Set(ctx, chatFlow, handlers.StationInfoFlowType, handlers.WaitingForStationKindStage, stationName)
+		return getStationInfoChooseKindResponse(stationName, station.Name)
+	case chatFlow.Type == handlers.RouteFlowType && chatFlow.Stage == handlers.WaitingForOriginStage:
+		chatFlows.Set(ctx, chatFlow, handlers.RouteFlowType, handlers.WaitingForDestinationStage, stationName)
+		return &handlers.HandlerResponse{
+			Message: &tgBot.SendMessageParams{
+				Text: waitingForDestinationMessage,
+			},
+		}
+	case chatFlow.Type == handlers.RouteFlowType && chatFlow.Stage == handlers.WaitingForDestinationStage:
+		chatFlows.Set(ctx, chatFlow, handlers.RouteFlowType, handlers.WaitingForDateStage, chatFlow.Extra+"\x1b"+stationName)
+		return &handlers.HandlerResponse{
+			Message: &tgBot.SendMessageParams{
+				Text: chooseRouteDateMessage,
+				ReplyMarkup: getChooseDateKeyboard(func(date time.Time) string {
+					return fmt.Sprintf(handlers.RouteChooseDateCallbackQuery+"\x1b%d", date.Unix())
+				}),
+			},
+		}
+	}
+	return nil
+}
+
+func getStationInfoChooseKindResponse(stationName string, displayName string) *handlers.HandlerResponse {
 	return &handlers.HandlerResponse{
 		Message: &tgBot.SendMessageParams{
-			Text: chooseDateMessage,
+			Text: fmt.Sprintf(chooseStationKindMessage, displayName),
 			ReplyMarkup: models.InlineKeyboardMarkup{
-				InlineKeyboard: replyButtons,
+				InlineKeyboard: [][]models.InlineKeyboardButton{
+					{
+						{
+							Text:         arrivalsButton,
+							CallbackData: fmt.Sprintf(handlers.StationInfoChooseKindCallbackQuery+"\x1b%s\x1b%s", stationName, handlers.StationInfoArrivals),
+						}, {
+							Text:         departuresButton,
+							CallbackData: fmt.Sprintf(handlers.StationInfoChooseKindCallbackQuery+"\x1b%s\x1b%s", stationName, handlers.StationInfoDepartures),
+						},
+					},
+				},
 			},
 		},
 	}
 }
+
+func getStationInfoChooseWindowResponse(stationName string, kind string) *handlers.HandlerResponse {
+	now := time.Now().In(utils.Location)
+	midnightTomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, utils.Location)
+	windowButton := func(text string, from time.Time, until time.Time) models.InlineKeyboardButton {
+		return models.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: fmt.Sprintf(handlers.StationInfoChooseWindowCallbackQuery+"\x1b%s\x1b%s\x1b%d\x1b%d", stationName, kind, from.Unix(), until.Sub(from)/time.Minute),
+		}
+	}
+	return &handlers.HandlerResponse{
+		Message: &tgBot.SendMessageParams{
+			Text: chooseStationWindowMessage,
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: [][]models.InlineKeyboardButton{
+					{
+						windowButton("Next 2 hours", now, now.Add(time.Hour*2)),
+						windowButton("Next 6 hours", now, now.Add(time.Hour*6)),
+					},
+					{
+						windowButton("Rest of today", now, midnightTomorrow),
+						windowButton(fmt.Sprintf("Tomorrow (%s)", midnightTomorrow.Format("02.01")), midnightTomorrow, midnightTomorrow.AddDate(0, 0, 1)),
+					},
+				},
+			},
+		},
+	}
+}
+
+func handleRouteStages(ctx context.Context, chatFlows *handlers.ChatFlowStore, b *outbound.Sender, update *models.Update, source api.TrainDataSource, stations *api.StationIndex) *handlers.HandlerResponse {
+	var response *handlers.HandlerResponse
+
+	chatFlow := chatFlows.Get(ctx, update.Message.Chat.ID)
+	if strings.HasPrefix(update.Message.Text, routeCommand) {
+		// A new command always restarts the flow
+		origin := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, routeCommand))
+		chatFlows.Set(ctx, chatFlow, handlers.RouteFlowType, handlers.WaitingForOriginStage, "")
+		if len(origin) != 0 {
+			response = handleStationInput(ctx, chatFlows, chatFlow, stations, origin)
+		} else {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: waitingForOriginMessage,
+				},
+			}
+		}
+		return response
+	}
+
+	switch chatFlow.Stage {
+	case handlers.WaitingForOriginStage, handlers.WaitingForDestinationStage:
+		response = handleStationInput(ctx, chatFlows, chatFlow, stations, update.Message.Text)
+	case handlers.WaitingForDateStage:
+		date, err := utils.ParseDate(update.Message.Text)
+		if err != nil {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: invalidDateMessage,
+				},
+			}
+		} else {
+			response = executeRouteSearch(ctx, chatFlows, b, source, stations, update.Message.Chat.ID, chatFlow, date)
+		}
+	}
+	return response
+}
+
+// executeRouteSearch runs the search for the origin and destination stored in
+// the chat flow and resets the flow afterwards.
+func executeRouteSearch(ctx context.Context, chatFlows *handlers.ChatFlowStore, b *outbound.Sender, source api.TrainDataSource, stations *api.StationIndex, chatId int64, chatFlow *handlers.ChatFlow, date time.Time) *handlers.HandlerResponse {
+	extra := strings.Split(chatFlow.Extra, "\x1b")
+	if chatFlow.Type != handlers.RouteFlowType || chatFlow.Stage != handlers.WaitingForDateStage || len(extra) != 2 {
+		return nil
+	}
+
+	message, err := b.SendMessage(ctx, &tgBot.SendMessageParams{
+		ChatID: chatId,
+		Text:   pleaseWaitMessage,
+	})
+	response, _ := handlers.HandleRouteCommand(ctx, source, stations, extra[0], extra[1], date)
+	if err == nil && response != nil {
+		response.ProgressMessageToEditId = message.ID
+	}
+	chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+	return response
+}
+
+func handleCommuteStages(ctx context.Context, chatFlows *handlers.ChatFlowStore, update *models.Update, source api.TrainDataSource, subs *subscriptions.Subscriptions) *handlers.HandlerResponse {
+	var response *handlers.HandlerResponse
+
+	chatFlow := chatFlows.Get(ctx, update.Message.Chat.ID)
+	if strings.HasPrefix(update.Message.Text, commutesCommand) {
+		chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+		return subscriptions.GetCommutesResponse(subs.GetChatCommutes(update.Message.Chat.ID))
+	}
+
+	switch chatFlow.Stage {
+	case handlers.WaitingForTrainNumberStage:
+		trainNumber := strings.TrimSpace(update.Message.Text)
+		trainData, err := getCommuteTrainData(ctx, source, trainNumber)
+		if err != nil {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: fmt.Sprintf(commuteTrainNotFoundMessage, trainNumber),
+				},
+			}
+		} else if len(trainData.Groups) > 1 {
+			chatFlows.Set(ctx, chatFlow, handlers.CommuteFlowType, handlers.WaitingForCommuteGroupStage, trainNumber)
+			response = handlers.GetCommuteChooseGroupResponse(trainData)
+		} else {
+			response = chooseCommuteGroup(ctx, chatFlows, source, chatFlow, trainNumber, 0)
+		}
+	case handlers.WaitingForCommuteDaysStage:
+		mask, err := handlers.ParseWeekdays(update.Message.Text)
+		if err != nil {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: invalidCommuteDaysMessage,
+				},
+			}
+		} else {
+			response = chooseCommuteDays(ctx, chatFlows, chatFlow, mask)
+		}
+	case handlers.WaitingForCommuteWindowStage:
+		extra := strings.Split(chatFlow.Extra, "\x1b")
+		start, end, err := handlers.ParseTimeWindow(update.Message.Text)
+		if err != nil || len(extra) != 4 {
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: invalidCommuteWindowMessage,
+				},
+			}
+			break
+		}
+		groupIndex, _ := strconv.Atoi(extra[1])
+		mask, _ := strconv.ParseUint(extra[3], 10, 8)
+		err = subs.InsertCommute(subscriptions.Commute{
+			ChatId:      update.Message.Chat.ID,
+			TrainNumber: extra[0],
+			GroupIndex:  groupIndex,
+			Description: extra[2],
+			Weekdays:    uint8(mask),
+			WindowStart: start,
+			WindowEnd:   end,
+		})
+		chatFlows.Set(ctx, chatFlow, handlers.InitialFlowType, handlers.InitialFlowType, "")
+		if err != nil {
+			logging.FromContext(ctx).Error("Commute error", logging.Err(err))
+			response = &handlers.HandlerResponse{
+				Message: &tgBot.SendMessageParams{
+					Text: "Error when saving the commute.",
+				},
+			}
+			break
+		}
+		response = subscriptions.GetCommutesResponse(subs.GetChatCommutes(update.Message.Chat.ID))
+		response.Message.Text = commuteAddedMessage + "\n\n" + response.Message.Text
+	}
+	return response
+}
+
+// getCommuteTrainData fetches today's run of a train, used to check that the
+// train exists and to describe the commute.
+func getCommuteTrainData(ctx context.Context, source api.TrainDataSource, trainNumber string) (*api.TrainResponse, error) {
+	now := time.Now().In(utils.Location)
+	trainData, err := source.GetTrain(ctx, trainNumber, time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, utils.Location))
+	if err != nil {
+		return nil, err
+	}
+	if len(trainData.Groups) == 0 {
+		return nil, api.TrainNotFound
+	}
+	return trainData, nil
+}
+
+func chooseCommuteGroup(ctx context.Context, chatFlows *handlers.ChatFlowStore, source api.TrainDataSource, chatFlow *handlers.ChatFlow, trainNumber string, groupIndex int) *handlers.HandlerResponse {
+	description := ""
+	if trainData, err := getCommuteTrainData(ctx, source, trainNumber); err == nil && groupIndex >= 0 && groupIndex < len(trainData.Groups) {
+		route := trainData.Groups[groupIndex].Route
+		description = fmt.Sprintf("%s ➔ %s", route.From, route.To)
+	}
+	chatFlows.Set(ctx, chatFlow, handlers.CommuteFlowType, handlers.WaitingForCommuteDaysStage, fmt.Sprintf("%s\x1b%d\x1b%s", trainNumber, groupIndex, description))
+	return handlers.GetCommuteChooseDaysResponse()
+}
+
+func chooseCommuteDays(ctx context.Context, chatFlows *handlers.ChatFlowStore, chatFlow *handlers.ChatFlow, mask uint8) *handlers.HandlerResponse {
+	chatFlows.Set(ctx, chatFlow, handlers.CommuteFlowType, handlers.WaitingForCommuteWindowStage, fmt.Sprintf("%s\x1b%d", chatFlow.Extra, mask))
+	return &handlers.HandlerResponse{
+		Message: &tgBot.SendMessageParams{
+			Text: chooseCommuteWindowMessage,
+		},
+	}
+}
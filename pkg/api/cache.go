@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+)
+
+const (
+	DefaultTrainCacheTTL = 20 * time.Second
+)
+
+type trainCacheKey struct {
+	trainNumber string
+	// The day in utils.Location, since the API only uses the day of the date
+	day string
+}
+
+type trainCacheEntry struct {
+	trainData *TrainResponse
+	expires   time.Time
+}
+
+// trainCall is a lookup in progress, shared by all the callers asking for the
+// same train at the same time.
+type trainCall struct {
+	done      chan struct{}
+	trainData *TrainResponse
+	err       error
+}
+
+// CacheStats counts how train lookups were answered.
+type CacheStats struct {
+	Hits uint64
+	// Lookups that waited for a request already in progress
+	Coalesced uint64
+	Misses    uint64
+}
+
+// CachedSource caches the train lookups of another TrainDataSource for a short
+// time and coalesces concurrent lookups of the same train into one request.
+// The other lookups are passed through. The returned train data is shared
+// between callers and must not be modified.
+type CachedSource struct {
+	TrainDataSource
+	ttl time.Duration
+	now func() time.Time
+
+	mutex    sync.Mutex
+	entries  map[trainCacheKey]trainCacheEntry
+	inFlight map[trainCacheKey]*trainCall
+
+	hits      atomic.Uint64
+	coalesced atomic.Uint64
+	misses    atomic.Uint64
+}
+
+var _ TrainDataSource = (*CachedSource)(nil)
+
+func NewCachedSource(source TrainDataSource, ttl time.Duration) *CachedSource {
+	if ttl <= 0 {
+		ttl = DefaultTrainCacheTTL
+	}
+	return &CachedSource{
+		TrainDataSource: source,
+		ttl:             ttl,
+		now:             time.Now,
+		entries:         map[trainCacheKey]trainCacheEntry{},
+		inFlight:        map[trainCacheKey]*trainCall{},
+	}
+}
+
+func (source *CachedSource) GetTrain(ctx context.Context, trainNumber string, date time.Time) (*TrainResponse, error) {
+	key := trainCacheKey{
+		trainNumber: trainNumber,
+		day:         date.In(utils.Location).Format("2006-01-02"),
+	}
+
+	source.mutex.Lock()
+	if entry, ok := source.entries[key]; ok && source.now().Before(entry.expires) {
+		source.mutex.Unlock()
+		source.hits.Add(1)
+		return entry.trainData, nil
+	}
+	if call, ok := source.inFlight[key]; ok {
+		source.mutex.Unlock()
+		source.coalesced.Add(1)
+		select {
+		case <-call.done:
+			return call.trainData, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &trainCall{
+		done: make(chan struct{}),
+	}
+	source.inFlight[key] = call
+	source.mutex.Unlock()
+	source.misses.Add(1)
+
+	// Not bound to the first caller's context, since other callers may be
+	// waiting for the result; the client's timeout still applies
+	call.trainData, call.err = source.TrainDataSource.GetTrain(context.Background(), trainNumber, date)
+
+	source.mutex.Lock()
+	delete(source.inFlight, key)
+	if call.err == nil {
+		now := source.now()
+		// Drop expired entries so that the cache doesn't grow forever
+		for k, entry := range source.entries {
+			if now.After(entry.expires) {
+				delete(source.entries, k)
+			}
+		}
+		source.entries[key] = trainCacheEntry{
+			trainData: call.trainData,
+			expires:   now.Add(source.ttl),
+		}
+	}
+	source.mutex.Unlock()
+	close(call.done)
+
+	return call.trainData, call.err
+}
+
+func (source *CachedSource) Stats() CacheStats {
+	return CacheStats{
+		Hits:      source.hits.Load(),
+		Coalesced: source.coalesced.Load(),
+		Misses:    source.misses.Load(),
+	}
+}
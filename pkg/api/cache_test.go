@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+)
+
+// countingSource counts the train lookups, which wait for release if it is
+// set and fail with the errors in errs, in order.
+type countingSource struct {
+	TrainDataSource
+	calls   atomic.Int32
+	release chan struct{}
+
+	mutex sync.Mutex
+	errs  []error
+}
+
+func (source *countingSource) GetTrain(_ context.Context, trainNumber string, _ time.Time) (*TrainResponse, error) {
+	source.calls.Add(1)
+	if source.release != nil {
+		<-source.release
+	}
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if len(source.errs) > 0 {
+		err := source.errs[0]
+		source.errs = source.errs[1:]
+		return nil, err
+	}
+	return &TrainResponse{Number: trainNumber}, nil
+}
+
+func newTestCachedSource(source TrainDataSource) (*CachedSource, *time.Time) {
+	cached := NewCachedSource(source, time.Minute)
+	now := time.Date(2024, time.June, 10, 12, 0, 0, 0, utils.Location)
+	cached.now = func() time.Time {
+		return now
+	}
+	return cached, &now
+}
+
+func TestCachedSourceCoalesces(t *testing.T) {
+	upstream := &countingSource{
+		release: make(chan struct{}),
+	}
+	cached, _ := newTestCachedSource(upstream)
+	date := time.Date(2024, time.June, 10, 8, 0, 0, 0, utils.Location)
+
+	const callers = 10
+	results := make(chan *TrainResponse, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trainData, err := cached.GetTrain(context.Background(), "1741", date)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- trainData
+		}()
+	}
+	// Lets the upstream call finish once the others are waiting for it
+	for cached.Stats().Misses+cached.Stats().Coalesced < callers {
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+	wg.Wait()
+	close(results)
+
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Errorf("expected a single upstream call, got %d", calls)
+	}
+	var first *TrainResponse
+	for trainData := range results {
+		if first == nil {
+			first = trainData
+		}
+		if trainData != first {
+			t.Error("expected all the callers to get the same train data")
+		}
+	}
+	if stats := cached.Stats(); stats.Misses != 1 || stats.Coalesced != callers-1 {
+		t.Errorf("expected 1 miss and %d coalesced lookups, got %+v", callers-1, stats)
+	}
+}
+
+func TestCachedSourceTTL(t *testing.T) {
+	upstream := &countingSource{}
+	cached, now := newTestCachedSource(upstream)
+	morning := time.Date(2024, time.June, 10, 8, 0, 0, 0, utils.Location)
+	evening := time.Date(2024, time.June, 10, 20, 0, 0, 0, utils.Location)
+	tomorrow := time.Date(2024, time.June, 11, 8, 0, 0, 0, utils.Location)
+
+	tests := []struct {
+		name          string
+		advance       time.Duration
+		trainNumber   string
+		date          time.Time
+		expectedCalls int32
+	}{
+		{"first lookup", 0, "1741", morning, 1},
+		{"same day", 30 * time.Second, "1741", evening, 1},
+		{"another day", 0, "1741", tomorrow, 2},
+		{"another train", 0, "1742", morning, 3},
+		{"expired", 31 * time.Second, "1741", morning, 4},
+		{"refreshed", 59 * time.Second, "1741", morning, 4},
+	}
+	for _, test := range tests {
+		*now = now.Add(test.advance)
+		if _, err := cached.GetTrain(context.Background(), test.trainNumber, test.date); err != nil {
+			t.Fatal(err)
+		}
+		if calls := upstream.calls.Load(); calls != test.expectedCalls {
+			t.Errorf("%s: expected %d upstream calls, got %d", test.name, test.expectedCalls, calls)
+		}
+	}
+}
+
+func TestCachedSourceDoesNotCacheErrors(t *testing.T) {
+	upstream := &countingSource{
+		errs: []error{ServerError, TrainNotFound},
+	}
+	cached, _ := newTestCachedSource(upstream)
+	date := time.Date(2024, time.June, 10, 8, 0, 0, 0, utils.Location)
+
+	for _, expected := range []error{ServerError, TrainNotFound, nil} {
+		if _, err := cached.GetTrain(context.Background(), "1741", date); !errors.Is(err, expected) {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+	if _, err := cached.GetTrain(context.Background(), "1741", date); err != nil {
+		t.Errorf("expected the train to be cached, got %v", err)
+	}
+	if calls := upstream.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 upstream calls, got %d", calls)
+	}
+}
+
+func TestCachedSourceWaitingCallerCancelled(t *testing.T) {
+	upstream := &countingSource{
+		release: make(chan struct{}),
+	}
+	cached, _ := newTestCachedSource(upstream)
+	date := time.Date(2024, time.June, 10, 8, 0, 0, 0, utils.Location)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := cached.GetTrain(context.Background(), "1741", date)
+		first <- err
+	}()
+	for upstream.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Stops waiting without affecting the lookup in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cached.GetTrain(ctx, "1741", date); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	close(upstream.release)
+	if err := <-first; err != nil {
+		t.Errorf("expected the first lookup to succeed, got %v", err)
+	}
+}
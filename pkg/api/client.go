@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/health"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+)
+
+const (
+	DefaultApiUrl = "https://scraper.infotren.dcdev.ro/v3"
+
+	defaultTimeout        = 15 * time.Second
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultUserAgent      = "CfrTrainInfoTelegramBot"
+
+	// Only the start of an error body is kept, to help debugging
+	maxErrorBodyLength = 4096
+)
+
+var (
+	TrainNotFound   = fmt.Errorf("train not found")
+	StationNotFound = fmt.Errorf("station not found")
+	ServerError     = fmt.Errorf("server error")
+)
+
+// HTTPError is returned for non-2xx responses. It wraps TrainNotFound or
+// StationNotFound for 404 responses and ServerError otherwise, so it can be
+// checked with errors.Is.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+	Url        string
+	err        error
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("status code %d from %s: %s", e.StatusCode, e.Url, e.err.Error())
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.err
+}
+
+type ClientConfig struct {
+	// The scraper API base URL; defaults to DefaultApiUrl
+	BaseUrl string
+	// Timeout of each attempt of a request
+	Timeout time.Duration
+	// How many times a request is retried after a network error or a 5xx
+	// response; negative values disable retries
+	MaxRetries int
+	// Delay before the first retry, doubled for every following one
+	RetryBaseDelay time.Duration
+	UserAgent      string
+	HttpClient     *http.Client
+}
+
+// Client gets the data from the InfoTren scraper API.
+type Client struct {
+	baseUrl        *url.URL
+	timeout        time.Duration
+	maxRetries     int
+	retryBaseDelay time.Duration
+	userAgent      string
+	httpClient     *http.Client
+}
+
+var _ TrainDataSource = (*Client)(nil)
+
+// NewClient creates a client, using the defaults for the zero fields of config.
+func NewClient(config ClientConfig) (*Client, error) {
+	if len(config.BaseUrl) == 0 {
+		config.BaseUrl = DefaultApiUrl
+	}
+	baseUrl, err := url.Parse(config.BaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API URL %s: %w", config.BaseUrl, err)
+	}
+	if baseUrl.Scheme != "http" && baseUrl.Scheme != "https" {
+		return nil, fmt.Errorf("invalid API URL %s: scheme must be http or https", config.BaseUrl)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBaseDelay <= 0 {
+		config.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	if len(config.UserAgent) == 0 {
+		config.UserAgent = defaultUserAgent
+	}
+	if config.HttpClient == nil {
+		config.HttpClient = &http.Client{}
+	}
+	return &Client{
+		baseUrl:        baseUrl,
+		timeout:        config.Timeout,
+		maxRetries:     config.MaxRetries,
+		retryBaseDelay: config.RetryBaseDelay,
+		userAgent:      config.UserAgent,
+		httpClient:     config.HttpClient,
+	}, nil
+}
+
+// endpoint returns the URL of the given path under the base URL.
+func (client *Client) endpoint(path ...string) *url.URL {
+	u := *client.baseUrl
+	u.Path, _ = url.JoinPath(u.Path, path...)
+	return &u
+}
+
+// getJson performs a GET request to u and decodes the JSON body into dest,
+// retrying on network errors and 5xx responses. A 404 response is reported as
+// an HTTPError wrapping notFoundErr.
+func (client *Client) getJson(ctx context.Context, u *url.URL, dest any, notFoundErr error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		retryable, err = client.tryGetJson(ctx, u, dest, notFoundErr)
+		if err == nil || !retryable || attempt >= client.maxRetries || ctx.Err() != nil {
+			if ctx.Err() == nil {
+				// A 404 response still means the scraper is working
+				health.MarkApiCall(err == nil || errors.Is(err, notFoundErr))
+			}
+			return err
+		}
+
+		// Exponential backoff with up to 50% jitter, so that the workers
+		// don't all retry at the same time
+		delay := client.retryBaseDelay << attempt
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		logging.FromContext(ctx).Debug("Retrying request", "url", u.String(), "delay", delay, logging.Err(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (client *Client) tryGetJson(ctx context.Context, u *url.URL, dest any, notFoundErr error) (retryable bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, client.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", client.userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodyLength))
+		httpErr := &HTTPError{
+			StatusCode: res.StatusCode,
+			Body:       string(body),
+			Url:        u.String(),
+			err:        ServerError,
+		}
+		if res.StatusCode == http.StatusNotFound {
+			httpErr.err = notFoundErr
+		}
+		return res.StatusCode/100 == 5, httpErr
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		// The connection broke while reading the body
+		return true, err
+	}
+	if err := json.Unmarshal(body, dest); err != nil {
+		return false, fmt.Errorf("invalid response from %s: %w", u.String(), err)
+	}
+	return false, nil
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a server that replies with the given
+// status codes in order, and then with a train.
+func newTestClient(t *testing.T, config ClientConfig, statusCodes ...int) (*Client, *atomic.Int32) {
+	t.Helper()
+	attempts := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(attempts.Add(1)) - 1
+		if r.URL.Path != "/v3/trains/1741" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if attempt < len(statusCodes) {
+			w.WriteHeader(statusCodes[attempt])
+			_, _ = w.Write([]byte(`{"message":"attempt failed"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"rank":"IR","number":"1741"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	config.BaseUrl = server.URL + "/v3"
+	if config.RetryBaseDelay == 0 {
+		config.RetryBaseDelay = time.Millisecond
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, attempts
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxRetries       int
+		statusCodes      []int
+		expectedAttempts int32
+		expectedStatus   int
+		expectedErr      error
+	}{
+		{"success", 0, nil, 1, 0, nil},
+		{"5xx, then success", 0, []int{http.StatusBadGateway, http.StatusServiceUnavailable}, 3, 0, nil},
+		{"5xx until out of retries", 2, []int{500, 502, 503, 504}, 3, http.StatusServiceUnavailable, ServerError},
+		{"retries disabled", -1, []int{http.StatusInternalServerError}, 1, http.StatusInternalServerError, ServerError},
+		// Client errors won't go away by retrying
+		{"404", 0, []int{http.StatusNotFound}, 1, http.StatusNotFound, TrainNotFound},
+		{"4xx", 0, []int{http.StatusBadRequest}, 1, http.StatusBadRequest, ServerError},
+	}
+	for _, test := range tests {
+		client, attempts := newTestClient(t, ClientConfig{MaxRetries: test.maxRetries}, test.statusCodes...)
+		trainData, err := client.GetTrain(context.Background(), "1741", time.Now())
+		if attempts.Load() != test.expectedAttempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.expectedAttempts, attempts.Load())
+		}
+		if test.expectedErr == nil {
+			if err != nil || trainData == nil || trainData.Number != "1741" {
+				t.Errorf("%s: expected train 1741, got %+v, %v", test.name, trainData, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectedErr, err)
+		}
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("%s: expected an HTTPError, got %T", test.name, err)
+			continue
+		}
+		if httpErr.StatusCode != test.expectedStatus || httpErr.Body != `{"message":"attempt failed"}` {
+			t.Errorf("%s: expected status %d with the body, got %d with %q", test.name, test.expectedStatus, httpErr.StatusCode, httpErr.Body)
+		}
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestClientCancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancels a while after the first response arrives, so it happens while
+	// waiting to retry. The delay is long enough that the test times out
+	// otherwise.
+	httpClient := &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			res, err := http.DefaultTransport.RoundTrip(req)
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return res, err
+		}),
+	}
+	client, attempts := newTestClient(t, ClientConfig{RetryBaseDelay: time.Hour, HttpClient: httpClient}, http.StatusServiceUnavailable)
+
+	start := time.Now()
+	_, err := client.GetTrain(ctx, "1741", time.Now())
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the request to stop when cancelled, took %v", elapsed)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected no retries after cancelling, got %d attempts", attempts.Load())
+	}
+	// The error of the last attempt is kept, rather than the cancellation
+	if !errors.Is(err, ServerError) {
+		t.Errorf("expected %v, got %v", ServerError, err)
+	}
+}
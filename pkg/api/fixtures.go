@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// FixtureSource replays JSON responses recorded from the scraper API, so the
+// bot can run without network access. The date of a request is ignored and
+// the files are looked up as follows:
+//
+//	trains/<train number>.json
+//	stations/<station name>.json
+//	itineraries/<from>__<to>.json
+//	stations.json
+//
+// A missing file is reported the same way as a 404 from the API.
+type FixtureSource struct {
+	fsys fs.FS
+}
+
+var _ TrainDataSource = (*FixtureSource)(nil)
+
+func NewFixtureSource(fsys fs.FS) *FixtureSource {
+	return &FixtureSource{
+		fsys: fsys,
+	}
+}
+
+func (source *FixtureSource) GetTrain(_ context.Context, trainNumber string, _ time.Time) (*TrainResponse, error) {
+	var trainData TrainResponse
+	if err := source.readJson("trains/"+fixtureName(trainNumber)+".json", &trainData, TrainNotFound); err != nil {
+		return nil, fmt.Errorf("error getting train %s: %w", trainNumber, err)
+	}
+	return &trainData, nil
+}
+
+func (source *FixtureSource) GetStation(_ context.Context, stationName string, _ time.Time) (*StationResponse, error) {
+	var stationData StationResponse
+	if err := source.readJson("stations/"+fixtureName(stationName)+".json", &stationData, StationNotFound); err != nil {
+		return nil, fmt.Errorf("error getting station %s: %w", stationName, err)
+	}
+	return &stationData, nil
+}
+
+func (source *FixtureSource) GetItineraries(_ context.Context, from string, to string, _ time.Time) ([]Itinerary, error) {
+	var itineraries []Itinerary
+	if err := source.readJson("itineraries/"+fixtureName(from)+"__"+fixtureName(to)+".json", &itineraries, StationNotFound); err != nil {
+		return nil, fmt.Errorf("error getting itineraries %s - %s: %w", from, to, err)
+	}
+	return itineraries, nil
+}
+
+func (source *FixtureSource) GetStations(_ context.Context) ([]StationListItem, error) {
+	var stations []StationListItem
+	if err := source.readJson("stations.json", &stations, ServerError); err != nil {
+		return nil, fmt.Errorf("error getting stations: %w", err)
+	}
+	return stations, nil
+}
+
+func (source *FixtureSource) readJson(name string, dest any, notFoundErr error) error {
+	body, err := fs.ReadFile(source.fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return notFoundErr
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, dest)
+}
+
+// fixtureName makes a request parameter usable as a file name.
+func fixtureName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(name)
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type Itinerary struct {
+	Trains []ItineraryTrain `json:"trains"`
+}
+
+type ItineraryTrain struct {
+	From              string    `json:"from"`
+	To                string    `json:"to"`
+	IntermediateStops []string  `json:"intermediateStops"`
+	DepartureDate     time.Time `json:"departureDate"`
+	ArrivalDate       time.Time `json:"arrivalDate"`
+	Km                int       `json:"km"`
+	Operator          string    `json:"operator"`
+	TrainRank         string    `json:"trainRank"`
+	TrainNumber       string    `json:"trainNumber"`
+}
+
+func (client *Client) GetItineraries(ctx context.Context, from string, to string, date time.Time) ([]Itinerary, error) {
+	u := client.endpoint("itineraries")
+	query := u.Query()
+	query.Add("from", from)
+	query.Add("to", to)
+	query.Add("date", date.Format(time.RFC3339))
+	u.RawQuery = query.Encode()
+
+	var itineraries []Itinerary
+	if err := client.getJson(ctx, u, &itineraries, StationNotFound); err != nil {
+		return nil, fmt.Errorf("error getting itineraries %s - %s: %w", from, to, err)
+	}
+
+	return itineraries, nil
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// TrainDataSource provides the train, station and itinerary data the bot
+// displays.
+type TrainDataSource interface {
+	GetTrain(ctx context.Context, trainNumber string, date time.Time) (*TrainResponse, error)
+	GetStation(ctx context.Context, stationName string, date time.Time) (*StationResponse, error)
+	GetItineraries(ctx context.Context, from string, to string, date time.Time) ([]Itinerary, error)
+	GetStations(ctx context.Context) ([]StationListItem, error)
+}
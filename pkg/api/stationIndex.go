@@ -0,0 +1,340 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"gorm.io/gorm"
+)
+
+const (
+	// The station list rarely changes, so only refetch it once a week
+	stationIndexMaxAge = time.Hour * 24 * 7
+	// How long to wait after failing to refetch it
+	stationIndexRetryInterval = time.Hour
+)
+
+type StationListItem struct {
+	Name        string   `json:"name"`
+	LinkName    string   `json:"linkName"`
+	StoppedAtBy []string `json:"stoppedAtBy"`
+}
+
+// IndexedStation is the SQLite cache of the scraper's station list.
+type IndexedStation struct {
+	gorm.Model
+	Name     string
+	LinkName string
+}
+
+type StationMatch struct {
+	Station IndexedStation
+	// Lower is better; 0 means the normalized names are identical.
+	Score int
+}
+
+type indexEntry struct {
+	station IndexedStation
+	name    string
+	tokens  []string
+}
+
+type StationIndex struct {
+	mutex   sync.RWMutex
+	entries []indexEntry
+	// When the oldest station was fetched from the scraper
+	refreshedAt time.Time
+}
+
+func (client *Client) GetStations(ctx context.Context) ([]StationListItem, error) {
+	u := client.endpoint("stations")
+
+	var stations []StationListItem
+	if err := client.getJson(ctx, u, &stations, ServerError); err != nil {
+		return nil, fmt.Errorf("error getting stations: %w", err)
+	}
+
+	return stations, nil
+}
+
+// LoadStationIndex loads the station list from the database, refreshing it
+// from the scraper if it is missing or stale. If the refresh fails, the
+// cached list is used as is.
+func LoadStationIndex(ctx context.Context, source TrainDataSource, db *gorm.DB) (*StationIndex, error) {
+	stations := make([]IndexedStation, 0)
+	if err := db.WithContext(ctx).Find(&stations).Error; err != nil {
+		return nil, err
+	}
+
+	var refreshedAt time.Time
+	for i := range stations {
+		if i == 0 || stations[i].UpdatedAt.Before(refreshedAt) {
+			refreshedAt = stations[i].UpdatedAt
+		}
+	}
+	if time.Since(refreshedAt) > stationIndexMaxAge {
+		fetched, err := fetchStationIndex(ctx, source, db)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not refresh station list", logging.Err(err))
+		} else {
+			stations = fetched
+			refreshedAt = time.Now()
+		}
+	}
+
+	idx := &StationIndex{}
+	idx.setStations(stations, refreshedAt)
+	return idx, nil
+}
+
+// KeepFresh refetches the station list whenever it gets older than
+// stationIndexMaxAge, until ctx is done.
+func (idx *StationIndex) KeepFresh(ctx context.Context, source TrainDataSource, db *gorm.DB) {
+	idx.mutex.RLock()
+	next := idx.refreshedAt.Add(stationIndexMaxAge)
+	idx.mutex.RUnlock()
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		stations, err := fetchStationIndex(ctx, source, db)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not refresh station list", logging.Err(err))
+			next = time.Now().Add(stationIndexRetryInterval)
+			continue
+		}
+		idx.setStations(stations, time.Now())
+		logging.FromContext(ctx).Info("Refreshed station list", "stations", len(stations))
+		next = time.Now().Add(stationIndexMaxAge)
+	}
+}
+
+func fetchStationIndex(ctx context.Context, source TrainDataSource, db *gorm.DB) ([]IndexedStation, error) {
+	list, err := source.GetStations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stations := make([]IndexedStation, 0, len(list))
+	for _, item := range list {
+		linkName := item.LinkName
+		if len(linkName) == 0 {
+			linkName = item.Name
+		}
+		stations = append(stations, IndexedStation{
+			Name:     item.Name,
+			LinkName: linkName,
+		})
+	}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&IndexedStation{}).Error; err != nil {
+			return err
+		}
+		if len(stations) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&stations, 500).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stations, nil
+}
+
+func (idx *StationIndex) setStations(stations []IndexedStation, refreshedAt time.Time) {
+	entries := make([]indexEntry, 0, len(stations))
+	for _, station := range stations {
+		tokens := tokenizeStationName(station.Name)
+		entries = append(entries, indexEntry{
+			station: station,
+			name:    strings.Join(tokens, " "),
+			tokens:  tokens,
+		})
+	}
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.entries = entries
+	idx.refreshedAt = refreshedAt
+}
+
+func (idx *StationIndex) Len() int {
+	if idx == nil {
+		return 0
+	}
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return len(idx.entries)
+}
+
+// GetByLinkName returns the station with the given link name. Unlike the
+// IDs, link names don't change when the list is refetched.
+func (idx *StationIndex) GetByLinkName(linkName string) (*IndexedStation, bool) {
+	if idx == nil {
+		return nil, false
+	}
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	for i := range idx.entries {
+		if idx.entries[i].station.LinkName == linkName {
+			station := idx.entries[i].station
+			return &station, true
+		}
+	}
+	return nil, false
+}
+
+// DisplayName returns the name of the station with the given link name, or
+// the link name itself if the station is unknown.
+func (idx *StationIndex) DisplayName(linkName string) string {
+	if station, ok := idx.GetByLinkName(linkName); ok {
+		return station.Name
+	}
+	return linkName
+}
+
+// Search returns at most limit stations matching query, best matches first.
+// Matching ignores case, diacritics and punctuation, accepts prefixes of
+// each word ("buc nord") and tolerates small typos.
+func (idx *StationIndex) Search(query string, limit int) []StationMatch {
+	if idx == nil {
+		return nil
+	}
+	queryTokens := tokenizeStationName(query)
+	if len(queryTokens) == 0 {
+		return nil
+	}
+	normalizedQuery := strings.Join(queryTokens, " ")
+
+	idx.mutex.RLock()
+	matches := make([]StationMatch, 0)
+	for i := range idx.entries {
+		if score, ok := matchStation(&idx.entries[i], normalizedQuery, queryTokens); ok {
+			matches = append(matches, StationMatch{
+				Station: idx.entries[i].station,
+				Score:   score,
+			})
+		}
+	}
+	idx.mutex.RUnlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score < matches[j].Score
+		}
+		return len(matches[i].Station.Name) < len(matches[j].Station.Name)
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+func matchStation(entry *indexEntry, normalizedQuery string, queryTokens []string) (int, bool) {
+	if entry.name == normalizedQuery {
+		return 0, true
+	}
+
+	allPrefixes := true
+	for _, queryToken := range queryTokens {
+		found := false
+		for _, token := range entry.tokens {
+			if strings.HasPrefix(token, queryToken) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			allPrefixes = false
+			break
+		}
+	}
+	if allPrefixes {
+		return 1, true
+	}
+
+	if strings.Contains(entry.name, normalizedQuery) {
+		return 2, true
+	}
+
+	totalDistance := 0
+	for _, queryToken := range queryTokens {
+		tolerance := typoTolerance(queryToken)
+		best := tolerance + 1
+		for _, token := range entry.tokens {
+			distance := levenshtein(queryToken, token)
+			if len(token) > len(queryToken) {
+				// Also allow typos in a prefix of the word
+				if prefixDistance := levenshtein(queryToken, token[:len(queryToken)]); prefixDistance < distance {
+					distance = prefixDistance
+				}
+			}
+			if distance < best {
+				best = distance
+			}
+		}
+		if best > tolerance {
+			return 0, false
+		}
+		totalDistance += best
+	}
+	return 3 + totalDistance, true
+}
+
+func typoTolerance(token string) int {
+	switch {
+	case len(token) <= 3:
+		return 0
+	case len(token) <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+var diacriticsReplacer = strings.NewReplacer(
+	"ă", "a", "â", "a", "î", "i", "ș", "s", "ş", "s", "ț", "t", "ţ", "t",
+	"á", "a", "é", "e", "í", "i", "ó", "o", "ö", "o", "ő", "o", "ú", "u", "ü", "u", "ű", "u",
+)
+
+// tokenizeStationName lowercases s, strips diacritics and splits it into
+// alphanumeric words.
+func tokenizeStationName(s string) []string {
+	s = diacriticsReplacer.Replace(strings.ToLower(s))
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
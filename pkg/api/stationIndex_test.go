@@ -0,0 +1,197 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStationIndex() *StationIndex {
+	names := []string{
+		"București Nord",
+		"București Obor",
+		"București Băneasa",
+		"Buciumeni",
+		"Brașov",
+		"Bran",
+		"Cluj Napoca Est",
+		"Cluj Napoca",
+		"Ploiești Vest",
+		"Ploiești Sud",
+	}
+	stations := make([]IndexedStation, 0, len(names))
+	for _, name := range names {
+		stations = append(stations, IndexedStation{
+			Name:     name,
+			LinkName: name,
+		})
+	}
+	idx := &StationIndex{}
+	idx.setStations(stations, time.Now())
+	return idx
+}
+
+func TestStationIndexSearch(t *testing.T) {
+	idx := newTestStationIndex()
+	tests := []struct {
+		query    string
+		limit    int
+		expected []string
+	}{
+		// Diacritics and case are ignored
+		{"bucuresti nord", 0, []string{"București Nord"}},
+		{"București Nord", 0, []string{"București Nord"}},
+		{"BUCURESTI-NORD", 0, []string{"București Nord"}},
+		// Prefixes of every word
+		{"buc nord", 0, []string{"București Nord"}},
+		{"cluj", 0, []string{"Cluj Napoca", "Cluj Napoca Est"}},
+		{"ploiesti", 0, []string{"Ploiești Sud", "Ploiești Vest"}},
+		// Ties are broken by the shorter name, then by the order in the index
+		{"bucuresti", 0, []string{"București Nord", "București Obor", "București Băneasa"}},
+		{"bucuresti", 2, []string{"București Nord", "București Obor"}},
+		// Exact matches come before prefixes
+		{"cluj napoca", 0, []string{"Cluj Napoca", "Cluj Napoca Est"}},
+		// One letter off
+		{"brasv", 0, []string{"Brașov"}},
+		{"brasob", 0, []string{"Brașov"}},
+		{"bucurezti nord", 0, []string{"București Nord"}},
+		// Short words must match exactly
+		{"bcu", 0, []string{}},
+		{"xyz", 0, []string{}},
+		{"  ", 0, []string{}},
+	}
+	for _, test := range tests {
+		matches := idx.Search(test.query, test.limit)
+		names := make([]string, 0, len(matches))
+		for _, match := range matches {
+			names = append(names, match.Station.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Search(%q, %d): expected %v, got %v", test.query, test.limit, test.expected, names)
+		}
+	}
+}
+
+func TestStationIndexSearchScores(t *testing.T) {
+	idx := newTestStationIndex()
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"bucuresti nord", 0},
+		{"buc nord", 1},
+		{"napoca est", 1},
+		{"brasv", 4},
+		{"bucurezti nord", 4},
+		{"bucurezti nordd", 5},
+	}
+	for _, test := range tests {
+		matches := idx.Search(test.query, 1)
+		if len(matches) == 0 {
+			t.Errorf("Search(%q): expected a match", test.query)
+			continue
+		}
+		if matches[0].Score != test.expected {
+			t.Errorf("Search(%q): expected score %d for %s, got %d", test.query, test.expected, matches[0].Station.Name, matches[0].Score)
+		}
+	}
+}
+
+func TestMatchStation(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected int
+		ok       bool
+	}{
+		{"București Nord", "bucuresti nord", 0, true},
+		{"București Nord", "nord buc", 1, true},
+		// Contained, but not at the start of the words
+		{"Cluj Napoca", "uj nap", 2, true},
+		{"Brașov", "brasov", 0, true},
+		{"Brașov", "brasv", 4, true},
+		// Typos are also allowed in a prefix of the word
+		{"Brașov", "bran", 4, true},
+		{"Brașov", "brno", 0, false},
+		{"Cluj Napoca", "clij napoka", 5, true},
+		{"Cluj Napoca", "clij napokaa", 6, true},
+		{"Cluj Napoca", "clij napokaaa", 0, false},
+	}
+	for _, test := range tests {
+		tokens := tokenizeStationName(test.name)
+		entry := indexEntry{
+			station: IndexedStation{Name: test.name},
+			name:    strings.Join(tokens, " "),
+			tokens:  tokens,
+		}
+		queryTokens := tokenizeStationName(test.query)
+		score, ok := matchStation(&entry, strings.Join(queryTokens, " "), queryTokens)
+		if ok != test.ok || (ok && score != test.expected) {
+			t.Errorf("matchStation(%q, %q): expected %d, %v, got %d, %v", test.name, test.query, test.expected, test.ok, score, ok)
+		}
+	}
+}
+
+func TestTokenizeStationName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"București Nord", []string{"bucuresti", "nord"}},
+		// Cedilla variants, as found in older data
+		{"Bucureşti Nord", []string{"bucuresti", "nord"}},
+		{"Târgu Mureș", []string{"targu", "mures"}},
+		{"Cluj-Napoca", []string{"cluj", "napoca"}},
+		{"Hm. Vlăhița (Gara)", []string{"hm", "vlahita", "gara"}},
+		{"  ", []string{}},
+	}
+	for _, test := range tests {
+		if tokens := tokenizeStationName(test.name); !reflect.DeepEqual(tokens, test.expected) {
+			t.Errorf("tokenizeStationName(%q): expected %v, got %v", test.name, test.expected, tokens)
+		}
+	}
+}
+
+func TestTypoTolerance(t *testing.T) {
+	tests := []struct {
+		token    string
+		expected int
+	}{
+		{"bu", 0},
+		{"buc", 0},
+		{"nord", 1},
+		{"brasov", 1},
+		{"ploiesti", 2},
+	}
+	for _, test := range tests {
+		if tolerance := typoTolerance(test.token); tolerance != test.expected {
+			t.Errorf("typoTolerance(%q): expected %d, got %d", test.token, test.expected, tolerance)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"", "", 0},
+		{"", "nord", 4},
+		{"nord", "nord", 0},
+		{"nord", "nrod", 2},
+		{"brasov", "brasv", 1},
+		{"brasov", "brasob", 1},
+		{"brasov", "brasovv", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if distance := levenshtein(test.a, test.b); distance != test.expected {
+			t.Errorf("levenshtein(%q, %q): expected %d, got %d", test.a, test.b, test.expected, distance)
+		}
+		if distance := levenshtein(test.b, test.a); distance != test.expected {
+			t.Errorf("levenshtein(%q, %q): expected %d, got %d", test.b, test.a, test.expected, distance)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type StationResponse struct {
+	StationName string          `json:"stationName"`
+	Date        string          `json:"date"`
+	Arrivals    []StationArrDep `json:"arrivals"`
+	Departures  []StationArrDep `json:"departures"`
+}
+
+type StationArrDep struct {
+	Time         time.Time `json:"time"`
+	StoppingTime *int      `json:"stoppingTime"`
+	Train        struct {
+		Rank          string    `json:"rank"`
+		Number        string    `json:"number"`
+		Operator      string    `json:"operator"`
+		Route         []string  `json:"route"`
+		DepartureDate time.Time `json:"departureDate"`
+	} `json:"train"`
+	Status *struct {
+		Delay     int     `json:"delay"`
+		Real      bool    `json:"real"`
+		Cancelled bool    `json:"cancelled"`
+		Platform  *string `json:"platform"`
+	} `json:"status"`
+}
+
+func (client *Client) GetStation(ctx context.Context, stationName string, date time.Time) (*StationResponse, error) {
+	u := client.endpoint("stations", stationName)
+	query := u.Query()
+	query.Add("date", date.Format(time.RFC3339))
+	u.RawQuery = query.Encode()
+
+	var stationData StationResponse
+	if err := client.getJson(ctx, u, &stationData, StationNotFound); err != nil {
+		return nil, fmt.Errorf("error getting station %s: %w", stationName, err)
+	}
+
+	return &stationData, nil
+}
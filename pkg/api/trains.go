@@ -2,11 +2,7 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 	"time"
 )
 
@@ -51,59 +47,14 @@ type TrainArrDep struct {
 	} `json:"status"`
 }
 
-const (
-	trainApiEndpoint = "https://scraper.infotren.dcdev.ro/v3"
-)
-
-var (
-	TrainNotFound = fmt.Errorf("train not found")
-	ServerError   = fmt.Errorf("server error")
-)
-
-func GetTrain(ctx context.Context, trainNumber string, date time.Time) (*TrainResponse, error) {
-	u, _ := url.Parse(trainApiEndpoint)
-	u.Path, _ = url.JoinPath(u.Path, "trains", trainNumber)
+func (client *Client) GetTrain(ctx context.Context, trainNumber string, date time.Time) (*TrainResponse, error) {
+	u := client.endpoint("trains", trainNumber)
 	query := u.Query()
 	query.Add("date", date.Format(time.RFC3339))
 	u.RawQuery = query.Encode()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("error getting train %s: %w", trainNumber, err)
-	}
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error getting train %s: %w", trainNumber, err)
-	}
-	defer func() {
-		_ = res.Body.Close()
-	}()
-
-	switch {
-	case res.StatusCode == http.StatusNotFound:
-		return nil, fmt.Errorf("error getting train %s: %w", trainNumber, TrainNotFound)
-	case res.StatusCode/100 != 2:
-		return nil, fmt.Errorf("error getting train %s: status code %d: %w", trainNumber, res.StatusCode, ServerError)
-	}
-
-	var body []byte
-	if res.ContentLength > 0 {
-		body = make([]byte, res.ContentLength)
-		n, err := io.ReadFull(res.Body, body)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("error getting train %s: %w", trainNumber, err)
-		} else if n != int(res.ContentLength) {
-			body = body[0:n]
-		}
-	} else {
-		body, err = io.ReadAll(res.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error getting train %s: %w", trainNumber, err)
-		}
-	}
 
 	var trainData TrainResponse
-	if err := json.Unmarshal(body, &trainData); err != nil {
+	if err := client.getJson(ctx, u, &trainData, TrainNotFound); err != nil {
 		return nil, fmt.Errorf("error getting train %s: %w", trainNumber, err)
 	}
 
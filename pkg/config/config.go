@@ -0,0 +1,303 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+)
+
+const (
+	envPrefix = "CFR_BOT."
+
+	// The same as subscriptions.DefaultPollingConfig
+	defaultWorkerCount            = 8
+	defaultPollMinInterval        = 20 * time.Second
+	defaultPollMaxInterval        = 10 * time.Minute
+	defaultUnsubscribeGracePeriod = 6 * time.Hour
+)
+
+var (
+	InvalidConfig = fmt.Errorf("invalid config")
+
+	// Allowed by Telegram for the secret_token of setWebhook
+	webhookSecretRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+)
+
+// Duration is a time.Duration written as a string, like "45s" or "6h", in the
+// config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config holds the settings of the bot. Each field can be set in the optional
+// JSON config file named by CFR_BOT.CONFIG_FILE, and is overridden by the
+// matching environment variable, e.g. CFR_BOT.WORKER_COUNT for WorkerCount.
+type Config struct {
+	Token  string `json:"token"`
+	DBPath string `json:"dbPath"`
+	// The scraper API base URL; empty for the default of api.ClientConfig
+	ApiUrl      string `json:"apiUrl"`
+	FixturesDir string `json:"fixturesDir"`
+	LogLevel    string `json:"logLevel"`
+	// Allow user messages to be logged at debug level
+	LogMessageText bool `json:"logMessageText"`
+	// Apply pending schema migrations when starting. Otherwise, they must be
+	// applied with the migrate command first.
+	MigrateOnStart bool `json:"migrateOnStart"`
+	// Connection string of a PostgreSQL database, used instead of the SQLite
+	// database at DBPath. Needed to run several instances of the bot, which
+	// then must use a webhook, since only one may poll for updates.
+	PostgresDsn string `json:"postgresDsn"`
+	// Identifies this instance when sharing the database with others; they
+	// must all use different ones. Defaults to the host name.
+	InstanceId string `json:"instanceId"`
+	// Address of the HTTP listener serving /metrics, /healthz and /readyz,
+	// e.g. ":9090"; empty disables it
+	HttpAddr string `json:"httpAddr"`
+
+	// Public HTTPS URL Telegram sends updates to. When set, the bot uses a
+	// webhook instead of long polling.
+	WebhookUrl string `json:"webhookUrl"`
+	// Address the webhook is served on, behind the reverse proxy. It may be
+	// the same as HttpAddr.
+	WebhookAddr string `json:"webhookAddr"`
+	// Sent by Telegram with every update; a random one is used if empty.
+	// Instances sharing a database must all use the same one.
+	WebhookSecret string `json:"webhookSecret"`
+	// Keep the webhook registered when stopping. By default it is deleted,
+	// unless a PostgreSQL database is used: instances sharing it also share
+	// the webhook, so the first one to stop would cut off the others.
+	WebhookKeepOnShutdown bool `json:"webhookKeepOnShutdown"`
+
+	// How many trains are checked at the same time
+	WorkerCount int `json:"workerCount"`
+	// Bounds of the interval between checks of a subscribed train
+	PollMinInterval Duration `json:"pollMinInterval"`
+	PollMaxInterval Duration `json:"pollMaxInterval"`
+	// How long after the scheduled arrival a tracked message is still updated
+	UnsubscribeGracePeriod Duration `json:"unsubscribeGracePeriod"`
+}
+
+func Default() Config {
+	hostname, _ := os.Hostname()
+	return Config{
+		DBPath:                 "bot_db.sqlite",
+		MigrateOnStart:         true,
+		InstanceId:             hostname,
+		WebhookAddr:            ":8080",
+		LogLevel:               "info",
+		WorkerCount:            defaultWorkerCount,
+		PollMinInterval:        Duration(defaultPollMinInterval),
+		PollMaxInterval:        Duration(defaultPollMaxInterval),
+		UnsubscribeGracePeriod: Duration(defaultUnsubscribeGracePeriod),
+	}
+}
+
+// Load reads the config file, if any, then the environment, and validates
+// the result.
+func Load() (Config, error) {
+	config, err := Read()
+	if err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// Read is like Load, but doesn't validate the result.
+func Read() (Config, error) {
+	config := Default()
+	if path := strings.TrimSpace(os.Getenv(envPrefix + "CONFIG_FILE")); len(path) != 0 {
+		if err := config.loadFile(path); err != nil {
+			return config, err
+		}
+	}
+	return config, config.loadEnv()
+}
+
+func (config *Config) loadFile(path string) error {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%w: %s: %s", InvalidConfig, path, err.Error())
+	}
+	return nil
+}
+
+func (config *Config) loadEnv() error {
+	errs := make([]error, 0)
+	lookup := func(name string) (string, bool) {
+		value, ok := os.LookupEnv(envPrefix + name)
+		value = strings.TrimSpace(value)
+		return value, ok && len(value) != 0
+	}
+	setString := func(name string, field *string) {
+		if value, ok := lookup(name); ok {
+			*field = value
+		}
+	}
+	setInt := func(name string, field *int) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: not a number: %q", envPrefix, name, value))
+				return
+			}
+			*field = parsed
+		}
+	}
+	setBool := func(name string, field *bool) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: not a boolean: %q", envPrefix, name, value))
+				return
+			}
+			*field = parsed
+		}
+	}
+	setDuration := func(name string, field *Duration) {
+		if value, ok := lookup(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: not a duration: %q", envPrefix, name, value))
+				return
+			}
+			*field = Duration(parsed)
+		}
+	}
+
+	setString("TOKEN", &config.Token)
+	setString("DB_PATH", &config.DBPath)
+	setBool("MIGRATE_ON_START", &config.MigrateOnStart)
+	setString("POSTGRES_DSN", &config.PostgresDsn)
+	setString("INSTANCE_ID", &config.InstanceId)
+	setString("API_URL", &config.ApiUrl)
+	setString("FIXTURES_DIR", &config.FixturesDir)
+	// DEBUG=true is a shortcut for the debug log level, unless one is given
+	if debug, err := strconv.ParseBool(strings.TrimSpace(os.Getenv("DEBUG"))); err == nil && debug {
+		config.LogLevel = "debug"
+	}
+	setString("LOG_LEVEL", &config.LogLevel)
+	setBool("LOG_MESSAGE_TEXT", &config.LogMessageText)
+	setString("HTTP_ADDR", &config.HttpAddr)
+	setString("WEBHOOK_URL", &config.WebhookUrl)
+	setString("WEBHOOK_ADDR", &config.WebhookAddr)
+	setString("WEBHOOK_SECRET", &config.WebhookSecret)
+	setBool("WEBHOOK_KEEP_ON_SHUTDOWN", &config.WebhookKeepOnShutdown)
+	setInt("WORKER_COUNT", &config.WorkerCount)
+	setDuration("POLL_MIN_INTERVAL", &config.PollMinInterval)
+	setDuration("POLL_MAX_INTERVAL", &config.PollMaxInterval)
+	setDuration("UNSUBSCRIBE_GRACE_PERIOD", &config.UnsubscribeGracePeriod)
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%w: %w", InvalidConfig, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Validate returns all problems with the config at once.
+func (config *Config) Validate() error {
+	errs := config.databaseErrors()
+	if len(config.Token) == 0 {
+		errs = append(errs, fmt.Errorf("no bot token supplied; supply with %sTOKEN", envPrefix))
+	}
+	if len(config.InstanceId) == 0 {
+		errs = append(errs, fmt.Errorf("the instance id must not be empty; supply with %sINSTANCE_ID", envPrefix))
+	}
+	if len(config.HttpAddr) != 0 {
+		if _, _, err := net.SplitHostPort(config.HttpAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid HTTP address %q: %w", config.HttpAddr, err))
+		}
+	}
+	if len(config.WebhookUrl) != 0 {
+		if u, err := url.Parse(config.WebhookUrl); err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+			errs = append(errs, fmt.Errorf("invalid webhook URL %q; Telegram requires an https URL", config.WebhookUrl))
+		}
+		if _, _, err := net.SplitHostPort(config.WebhookAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid webhook address %q: %w", config.WebhookAddr, err))
+		}
+		if len(config.WebhookSecret) != 0 && !webhookSecretRegexp.MatchString(config.WebhookSecret) {
+			errs = append(errs, fmt.Errorf("the webhook secret must be 1-256 characters of A-Z, a-z, 0-9, _ and -"))
+		}
+	}
+	if len(config.PostgresDsn) != 0 {
+		// Instances sharing the database would compete for updates when
+		// polling, and overwrite each other's random webhook secret
+		if len(config.WebhookUrl) == 0 {
+			errs = append(errs, fmt.Errorf("a PostgreSQL database can be shared by several instances, so it requires a webhook; supply with %sWEBHOOK_URL", envPrefix))
+		} else if len(config.WebhookSecret) == 0 {
+			errs = append(errs, fmt.Errorf("a PostgreSQL database can be shared by several instances, so it requires a fixed webhook secret; supply with %sWEBHOOK_SECRET", envPrefix))
+		}
+	}
+	if config.WorkerCount < 1 || config.WorkerCount > 64 {
+		errs = append(errs, fmt.Errorf("the worker count must be between 1 and 64, got %d", config.WorkerCount))
+	}
+	if config.PollMinInterval < Duration(time.Second*5) {
+		errs = append(errs, fmt.Errorf("the minimum poll interval must be at least 5s, got %s", time.Duration(config.PollMinInterval)))
+	}
+	if config.PollMaxInterval < config.PollMinInterval {
+		errs = append(errs, fmt.Errorf("the maximum poll interval (%s) must not be less than the minimum (%s)", time.Duration(config.PollMaxInterval), time.Duration(config.PollMinInterval)))
+	}
+	if config.UnsubscribeGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("the unsubscribe grace period must not be negative"))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%w: %w", InvalidConfig, errors.Join(errs...))
+	}
+	return nil
+}
+
+// ValidateDatabase only checks the settings needed to log and to open the
+// database, for commands that don't run the bot.
+func (config *Config) ValidateDatabase() error {
+	if errs := config.databaseErrors(); len(errs) != 0 {
+		return fmt.Errorf("%w: %w", InvalidConfig, errors.Join(errs...))
+	}
+	return nil
+}
+
+func (config *Config) databaseErrors() []error {
+	errs := make([]error, 0)
+	if len(config.DBPath) == 0 && len(config.PostgresDsn) == 0 {
+		errs = append(errs, fmt.Errorf("the DB path must not be empty"))
+	}
+	if _, err := logging.ParseLevel(config.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// DeleteWebhookOnShutdown returns whether the webhook is deregistered when
+// the bot stops, see WebhookKeepOnShutdown.
+func (config *Config) DeleteWebhookOnShutdown() bool {
+	return !config.WebhookKeepOnShutdown && len(config.PostgresDsn) == 0
+}
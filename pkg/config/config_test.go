@@ -0,0 +1,194 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/subscriptions"
+)
+
+func validConfig() Config {
+	config := Default()
+	config.Token = "123:abc"
+	config.InstanceId = "test"
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(config *Config)
+		expected string
+	}{
+		{"valid", func(config *Config) {}, ""},
+		{"no token", func(config *Config) { config.Token = "" }, "no bot token"},
+		{"no database", func(config *Config) { config.DBPath = "" }, "DB path"},
+		{"bad log level", func(config *Config) { config.LogLevel = "loud" }, "loud"},
+		{"no workers", func(config *Config) { config.WorkerCount = 0 }, "worker count"},
+		{"too many workers", func(config *Config) { config.WorkerCount = 65 }, "worker count"},
+		{"short poll interval", func(config *Config) { config.PollMinInterval = Duration(time.Second) }, "minimum poll interval"},
+		{"poll bounds reversed", func(config *Config) { config.PollMaxInterval = Duration(10 * time.Second) }, "maximum poll interval"},
+		{"negative grace period", func(config *Config) { config.UnsubscribeGracePeriod = Duration(-time.Hour) }, "grace period"},
+		{"bad HTTP address", func(config *Config) { config.HttpAddr = "9090" }, "HTTP address"},
+		{"webhook without https", func(config *Config) { config.WebhookUrl = "http://bot.example.com/hook" }, "https"},
+		{"bad webhook secret", func(config *Config) {
+			config.WebhookUrl = "https://bot.example.com/hook"
+			config.WebhookSecret = "not a secret!"
+		}, "webhook secret"},
+		// Instances sharing a database can't all poll for updates
+		{"postgres without webhook", func(config *Config) { config.PostgresDsn = "host=db" }, "WEBHOOK_URL"},
+		{"postgres without webhook secret", func(config *Config) {
+			config.PostgresDsn = "host=db"
+			config.WebhookUrl = "https://bot.example.com/hook"
+		}, "WEBHOOK_SECRET"},
+		{"postgres with webhook", func(config *Config) {
+			config.DBPath = ""
+			config.PostgresDsn = "host=db"
+			config.WebhookUrl = "https://bot.example.com/hook"
+			config.WebhookSecret = "secret"
+		}, ""},
+	}
+	for _, test := range tests {
+		config := validConfig()
+		test.change(&config)
+		err := config.Validate()
+		if len(test.expected) == 0 {
+			if err != nil {
+				t.Errorf("%s: expected a valid config, got %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, InvalidConfig) || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error about %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	config := validConfig()
+	config.Token = ""
+	config.WorkerCount = 0
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "no bot token") || !strings.Contains(err.Error(), "worker count") {
+		t.Errorf("expected both errors, got %v", err)
+	}
+}
+
+// setEnv sets the given variables, prefixed with envPrefix, and unsets the
+// others that are read, so the environment of the test doesn't interfere.
+func setEnv(t *testing.T, values map[string]string) {
+	t.Helper()
+	for _, name := range []string{"CONFIG_FILE", "TOKEN", "DB_PATH", "POSTGRES_DSN", "INSTANCE_ID", "API_URL", "LOG_LEVEL", "WORKER_COUNT", "POLL_MIN_INTERVAL", "POLL_MAX_INTERVAL", "UNSUBSCRIBE_GRACE_PERIOD", "WEBHOOK_URL", "WEBHOOK_SECRET", "WEBHOOK_KEEP_ON_SHUTDOWN"} {
+		t.Setenv(envPrefix+name, values[name])
+	}
+	t.Setenv("DEBUG", "")
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"token": "from-file",
+		"dbPath": "file.sqlite",
+		"workerCount": 4,
+		"pollMinInterval": "30s",
+		"webhookKeepOnShutdown": true
+	}`)
+	setEnv(t, map[string]string{
+		"CONFIG_FILE":       path,
+		"TOKEN":             "from-env",
+		"POLL_MIN_INTERVAL": " 45s ",
+		// Empty variables are ignored
+		"WORKER_COUNT": "",
+	})
+
+	config, err := Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Token != "from-env" {
+		t.Errorf("expected the environment to override the file, got %q", config.Token)
+	}
+	if config.DBPath != "file.sqlite" || config.WorkerCount != 4 || !config.WebhookKeepOnShutdown {
+		t.Errorf("expected the values of the file, got %+v", config)
+	}
+	if config.PollMinInterval != Duration(45*time.Second) {
+		t.Errorf("expected the interval of the environment, got %v", time.Duration(config.PollMinInterval))
+	}
+	if config.PollMaxInterval != Duration(defaultPollMaxInterval) {
+		t.Errorf("expected the default for missing values, got %v", time.Duration(config.PollMaxInterval))
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		expected string
+	}{
+		{"bad duration", "", map[string]string{"POLL_MAX_INTERVAL": "10 minutes"}, "POLL_MAX_INTERVAL"},
+		{"bad worker count", "", map[string]string{"WORKER_COUNT": "eight"}, "WORKER_COUNT"},
+		{"bad boolean", "", map[string]string{"WEBHOOK_KEEP_ON_SHUTDOWN": "sometimes"}, "WEBHOOK_KEEP_ON_SHUTDOWN"},
+		{"bad duration in file", `{"pollMinInterval": "soon"}`, nil, "soon"},
+		{"unknown field in file", `{"workers": 4}`, nil, "workers"},
+	}
+	for _, test := range tests {
+		env := map[string]string{}
+		for name, value := range test.env {
+			env[name] = value
+		}
+		if len(test.file) != 0 {
+			env["CONFIG_FILE"] = writeConfigFile(t, test.file)
+		}
+		setEnv(t, env)
+		_, err := Read()
+		if !errors.Is(err, InvalidConfig) || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error about %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestDefaultsMatchPolling(t *testing.T) {
+	config := Default()
+	polling := subscriptions.DefaultPollingConfig
+	if config.WorkerCount != polling.WorkerCount ||
+		time.Duration(config.PollMinInterval) != polling.MinInterval ||
+		time.Duration(config.PollMaxInterval) != polling.MaxInterval ||
+		time.Duration(config.UnsubscribeGracePeriod) != polling.UnsubscribeGracePeriod {
+		t.Errorf("expected the defaults of %+v, got %+v", polling, config)
+	}
+}
+
+func TestDeleteWebhookOnShutdown(t *testing.T) {
+	tests := []struct {
+		postgresDsn string
+		keep        bool
+		expected    bool
+	}{
+		{"", false, true},
+		{"", true, false},
+		// Shared with other instances
+		{"host=db", false, false},
+		{"host=db", true, false},
+	}
+	for _, test := range tests {
+		config := validConfig()
+		config.PostgresDsn = test.postgresDsn
+		config.WebhookKeepOnShutdown = test.keep
+		if deleted := config.DeleteWebhookOnShutdown(); deleted != test.expected {
+			t.Errorf("DSN %q, keep %v: expected %v, got %v", test.postgresDsn, test.keep, test.expected, deleted)
+		}
+	}
+}
@@ -1,28 +1,49 @@
 package database
 
 import (
-	"sync"
+	"context"
+	"fmt"
 
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
-var (
-	db    *gorm.DB
-	mutex sync.RWMutex
-)
+// Open opens the SQLite database at path. Writers wait for each other
+// instead of failing, so the stores can be used concurrently.
+func Open(path string) (*gorm.DB, error) {
+	return gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path)), &gorm.Config{})
+}
 
-func SetDatabase(d *gorm.DB) {
-	db = d
+// OpenPostgres connects to a PostgreSQL database. dsn is either a URL or a
+// list of key=value settings, as accepted by libpq.
+func OpenPostgres(dsn string) (*gorm.DB, error) {
+	return gorm.Open(postgres.Open(dsn), &gorm.Config{})
 }
 
-func ReadDB[T any](callback func(*gorm.DB) (T, error)) (T, error) {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	return callback(db)
+// OpenInMemory opens an empty database with the bot's tables, for tests.
+// Every call returns a separate database.
+func OpenInMemory() (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// Each connection to :memory: is a different database
+	sqlDB.SetMaxOpenConns(1)
+	if err := MigrateUp(db); err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
-func WriteDB[T any](callback func(*gorm.DB) (T, error)) (T, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	return callback(db)
+// Ping checks that the database can still be queried.
+func Ping(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Exec("SELECT 1").Error
 }
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The tables as created by AutoMigrate before migrations existed. They are
+// copies of the models, so that changing a model doesn't change the
+// migration. Since AutoMigrate only adds what's missing, databases created
+// before migrations existed are taken over as they are.
+
+type chatFlowV1 struct {
+	gorm.Model
+	ChatId int64
+	Type   string
+	Stage  string
+	Extra  string
+}
+
+func (chatFlowV1) TableName() string {
+	return "chat_flows"
+}
+
+type subDataV1 struct {
+	gorm.Model
+	ChatId          int64
+	MessageId       int
+	InlineMessageId string
+	TrainNumber     string
+	Date            time.Time
+	GroupIndex      int
+	FromStation     string
+	ToStation       string
+
+	NotifyDelayThreshold int
+	NotifyCancellation   bool
+	NotifyPlatformChange bool
+	NotifyDeparture      bool
+
+	NotifyStateDelayNotified        bool
+	NotifyStateCancellationNotified bool
+	NotifyStateLastPlatform         string
+	NotifyStateDepartureNotified    bool
+}
+
+func (subDataV1) TableName() string {
+	return "sub_data"
+}
+
+type indexedStationV1 struct {
+	gorm.Model
+	Name     string
+	LinkName string
+}
+
+func (indexedStationV1) TableName() string {
+	return "indexed_stations"
+}
+
+type commuteV1 struct {
+	gorm.Model
+	ChatId      int64
+	TrainNumber string
+	GroupIndex  int
+	Description string
+	Weekdays    uint8
+	WindowStart int
+	WindowEnd   int
+	Paused      bool
+	LastSpawned string
+}
+
+func (commuteV1) TableName() string {
+	return "commutes"
+}
+
+func initialSchemaUp(tx *gorm.DB) error {
+	return tx.AutoMigrate(&chatFlowV1{}, &subDataV1{}, &indexedStationV1{}, &commuteV1{})
+}
+
+func initialSchemaDown(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&chatFlowV1{}, &subDataV1{}, &indexedStationV1{}, &commuteV1{})
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// trainLeaseV2 records which instance checks a train run, so that instances
+// sharing the database don't check the same train.
+type trainLeaseV2 struct {
+	TrainNumber string `gorm:"primaryKey"`
+	Day         string `gorm:"primaryKey"`
+	Owner       string
+	ExpiresAt   time.Time
+}
+
+func (trainLeaseV2) TableName() string {
+	return "train_leases"
+}
+
+func trainLeasesUp(tx *gorm.DB) error {
+	if err := tx.Migrator().CreateTable(&trainLeaseV2{}); err != nil {
+		return err
+	}
+	// Every update looks up the chat flow, which is slow without an index
+	// on PostgreSQL
+	if err := tx.Exec("CREATE INDEX idx_chat_flows_chat_id ON chat_flows (chat_id)").Error; err != nil {
+		return err
+	}
+	return tx.Exec("CREATE INDEX idx_sub_data_chat_id ON sub_data (chat_id)").Error
+}
+
+func trainLeasesDown(tx *gorm.DB) error {
+	if err := tx.Exec("DROP INDEX idx_sub_data_chat_id").Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("DROP INDEX idx_chat_flows_chat_id").Error; err != nil {
+		return err
+	}
+	return tx.Migrator().DropTable(&trainLeaseV2{})
+}
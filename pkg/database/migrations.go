@@ -0,0 +1,200 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration changes the schema from Version-1 to Version. Up and Down run in
+// a transaction together with the update of the schema_version table.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// Migrations must be in order, numbered from 1 without gaps. Once released, a
+// migration must not be changed; add a new one instead.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      initialSchemaUp,
+		Down:    initialSchemaDown,
+	},
+	{
+		Version: 2,
+		Name:    "train leases and chat indexes",
+		Up:      trainLeasesUp,
+		Down:    trainLeasesDown,
+	},
+}
+
+// Arbitrary key of the PostgreSQL advisory lock held while migrating, so
+// that instances starting at the same time don't migrate concurrently
+const migrationLockKey = 0x43465242
+
+var (
+	UnknownSchemaVersion = fmt.Errorf("unknown schema version")
+	OutdatedSchema       = fmt.Errorf("outdated schema")
+)
+
+// appliedMigration is a row of the schema_version table. A row exists for
+// every migration that was applied and not rolled back.
+type appliedMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (appliedMigration) TableName() string {
+	return "schema_version"
+}
+
+// LatestVersion returns the schema version this build expects.
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the database's schema, 0 if it is
+// empty. It doesn't change the database.
+func SchemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&appliedMigration{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&appliedMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// MigrateUp applies all migrations that weren't applied yet.
+func MigrateUp(db *gorm.DB) error {
+	return MigrateTo(db, LatestVersion())
+}
+
+// MigrateTo applies or rolls back migrations until the schema is at target.
+func MigrateTo(db *gorm.DB, target int) error {
+	if target < 0 || target > LatestVersion() {
+		return fmt.Errorf("%w: %d", UnknownSchemaVersion, target)
+	}
+	// The lock belongs to the session, so all statements must use the same
+	// connection
+	return db.Connection(func(conn *gorm.DB) error {
+		// Otherwise the statements share their clauses
+		conn = conn.Session(&gorm.Session{NewDB: true})
+		if conn.Dialector.Name() == "postgres" {
+			if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockKey).Error; err != nil {
+				return err
+			}
+			defer conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockKey)
+		}
+
+		if err := conn.AutoMigrate(&appliedMigration{}); err != nil {
+			return err
+		}
+		current, err := SchemaVersion(conn)
+		if err != nil {
+			return err
+		}
+		if current > LatestVersion() {
+			return fmt.Errorf("%w: the database is at version %d, but this build only knows up to %d", UnknownSchemaVersion, current, LatestVersion())
+		}
+		for ; current < target; current++ {
+			if err := applyMigration(conn, Migrations[current]); err != nil {
+				return err
+			}
+		}
+		for ; current > target; current-- {
+			if err := rollbackMigration(conn, Migrations[current-1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CheckSchema returns an error unless all migrations were applied. It doesn't
+// change the database.
+func CheckSchema(db *gorm.DB) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current > LatestVersion():
+		return fmt.Errorf("%w: the database is at version %d, but this build only knows up to %d", UnknownSchemaVersion, current, LatestVersion())
+	case current < LatestVersion():
+		return fmt.Errorf("%w: the database is at version %d, expected %d", OutdatedSchema, current, LatestVersion())
+	}
+	return nil
+}
+
+func applyMigration(db *gorm.DB, migration Migration) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := migration.Up(tx); err != nil {
+			return err
+		}
+		return tx.Create(&appliedMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("applying migration %d (%s): %w", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+func rollbackMigration(db *gorm.DB, migration Migration) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if migration.Down == nil {
+			return errors.New("the migration can't be rolled back")
+		}
+		if err := migration.Down(tx); err != nil {
+			return err
+		}
+		return tx.Delete(&appliedMigration{}, migration.Version).Error
+	})
+	if err != nil {
+		return fmt.Errorf("rolling back migration %d (%s): %w", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+// MigrationStatus is a migration and whether it was applied.
+type MigrationStatus struct {
+	Migration
+	// Nil if the migration wasn't applied
+	AppliedAt *time.Time
+}
+
+// Status returns every known migration, along with when it was applied. It
+// doesn't change the database.
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	applied := make([]appliedMigration, 0)
+	if db.Migrator().HasTable(&appliedMigration{}) {
+		if err := db.Find(&applied).Error; err != nil {
+			return nil, err
+		}
+	}
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, row := range applied {
+		appliedAt[row.Version] = row.AppliedAt
+	}
+	statuses := make([]MigrationStatus, 0, len(Migrations))
+	for _, migration := range Migrations {
+		status := MigrationStatus{
+			Migration: migration,
+		}
+		if at, ok := appliedAt[migration.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
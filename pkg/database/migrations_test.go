@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openEmpty(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	return db
+}
+
+func TestCheckSchemaDoesNotWrite(t *testing.T) {
+	db := openEmpty(t)
+
+	if err := CheckSchema(db); !errors.Is(err, OutdatedSchema) {
+		t.Errorf("expected %v for an empty database, got %v", OutdatedSchema, err)
+	}
+	statuses, err := Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Errorf("expected migration %d not to be applied", status.Version)
+		}
+	}
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 0 {
+		t.Errorf("expected no tables to be created, got %v", tables)
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := openEmpty(t)
+
+	if err := MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(db); err != nil {
+		t.Errorf("expected the schema to be up to date, got %v", err)
+	}
+
+	if err := MigrateTo(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := SchemaVersion(db); err != nil || version != 0 {
+		t.Errorf("expected version 0, got %d, %v", version, err)
+	}
+	if db.Migrator().HasTable("sub_data") {
+		t.Error("expected the tables to be dropped")
+	}
+}
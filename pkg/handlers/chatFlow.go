@@ -1,9 +1,9 @@
 package handlers
 
 import (
-	"log"
+	"context"
 
-	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/database"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
 	"gorm.io/gorm"
 )
 
@@ -12,9 +12,21 @@ const (
 	TrainInfoFlowType   = "trainInfo"
 	StationInfoFlowType = "stationInfo"
 	RouteFlowType       = "route"
+	CommuteFlowType     = "commute"
 
 	WaitingForTrainNumberStage = "waitingForTrainNumber"
 	WaitingForDateStage        = "waitingForDate"
+
+	WaitingForStationNameStage   = "waitingForStationName"
+	WaitingForStationKindStage   = "waitingForStationKind"
+	WaitingForStationWindowStage = "waitingForStationWindow"
+
+	WaitingForOriginStage      = "waitingForOrigin"
+	WaitingForDestinationStage = "waitingForDestination"
+
+	WaitingForCommuteGroupStage  = "waitingForCommuteGroup"
+	WaitingForCommuteDaysStage   = "waitingForCommuteDays"
+	WaitingForCommuteWindowStage = "waitingForCommuteWindow"
 )
 
 type ChatFlow struct {
@@ -25,33 +37,53 @@ type ChatFlow struct {
 	Extra  string
 }
 
-func GetChatFlow(chatId int64) *ChatFlow {
+// ChatFlowStore persists the ChatFlow of every chat.
+type ChatFlowStore struct {
+	db *gorm.DB
+}
+
+func NewChatFlowStore(db *gorm.DB) *ChatFlowStore {
+	return &ChatFlowStore{
+		db: db,
+	}
+}
+
+// Get returns the ChatFlow of a chat, creating it in the initial flow if the
+// chat is new.
+func (store *ChatFlowStore) Get(ctx context.Context, chatId int64) *ChatFlow {
+	logger := logging.FromContext(ctx)
 	chatFlow := &ChatFlow{}
-	result, _ := database.ReadDB(func(db *gorm.DB) (*gorm.DB, error) {
-		return db.First(chatFlow, "chat_id = ?", chatId), nil
-	})
+	result := store.db.WithContext(ctx).Limit(1).Find(chatFlow, "chat_id = ?", chatId)
+	if result.Error != nil {
+		logger.Error("Reading chat flow", logging.ChatIdKey, chatId, logging.Err(result.Error))
+	}
 	if result.RowsAffected == 0 {
-		log.Printf("DEBUG: Chat not found in DB: %d\n", chatId)
+		logger.Debug("Chat not found in DB", logging.ChatIdKey, chatId)
 		chatFlow = &ChatFlow{
 			ChatId: chatId,
 			Type:   InitialFlowType,
 		}
-		_, _ = database.WriteDB(func(db *gorm.DB) (*gorm.DB, error) {
-			return db.Create(chatFlow), nil
-		})
+		if err := store.db.WithContext(ctx).Create(chatFlow).Error; err != nil {
+			logger.Error("Creating chat flow", logging.ChatIdKey, chatId, logging.Err(err))
+		}
 	} else {
-		log.Printf("DEBUG: Chat found in DB: %d, type %s, stage %s\n", chatId, chatFlow.Type, chatFlow.Stage)
+		logger.Debug("Chat found in DB", logging.ChatIdKey, chatId, "type", chatFlow.Type, "stage", chatFlow.Stage)
 	}
 	return chatFlow
 }
 
-func SetChatFlow(chatFlow *ChatFlow, flowType string, stage string, extra string) {
-	_, _ = database.WriteDB(func(db *gorm.DB) (*gorm.DB, error) {
-		return db.Model(chatFlow).Updates(ChatFlow{
-			Type:  flowType,
-			Stage: stage,
-			Extra: extra,
-		}), nil
-	})
-	log.Printf("DEBUG: setChatFlow type %s, stage %s", flowType, stage)
+func (store *ChatFlowStore) Set(ctx context.Context, chatFlow *ChatFlow, flowType string, stage string, extra string) {
+	logger := logging.FromContext(ctx)
+	err := store.db.WithContext(ctx).Model(chatFlow).Select("Type", "Stage", "Extra").Updates(ChatFlow{
+		Type:  flowType,
+		Stage: stage,
+		Extra: extra,
+	}).Error
+	if err != nil {
+		logger.Error("Saving chat flow", logging.ChatIdKey, chatFlow.ChatId, logging.Err(err))
+	}
+	chatFlow.Type = flowType
+	chatFlow.Stage = stage
+	chatFlow.Extra = extra
+	logger.Debug("Set chat flow", logging.ChatIdKey, chatFlow.ChatId, "type", flowType, "stage", stage)
 }
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/database"
+)
+
+func newTestChatFlowStore(t *testing.T) *ChatFlowStore {
+	t.Helper()
+	db, err := database.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewChatFlowStore(db)
+}
+
+func TestChatFlowStoreGetCreatesInitialFlow(t *testing.T) {
+	ctx := context.Background()
+	store := newTestChatFlowStore(t)
+
+	chatFlow := store.Get(ctx, 42)
+	if chatFlow.ChatId != 42 || chatFlow.Type != InitialFlowType || len(chatFlow.Stage) != 0 || len(chatFlow.Extra) != 0 {
+		t.Errorf("expected a new initial flow for chat 42, got %+v", chatFlow)
+	}
+	if chatFlow.ID == 0 {
+		t.Error("expected the new flow to be saved")
+	}
+
+	again := store.Get(ctx, 42)
+	if again.ID != chatFlow.ID {
+		t.Errorf("expected the saved flow %d, got %d", chatFlow.ID, again.ID)
+	}
+}
+
+func TestChatFlowStoreSet(t *testing.T) {
+	ctx := context.Background()
+	store := newTestChatFlowStore(t)
+
+	chatFlow := store.Get(ctx, 42)
+	other := store.Get(ctx, 43)
+	store.Set(ctx, chatFlow, TrainInfoFlowType, WaitingForDateStage, "1741")
+	if chatFlow.Type != TrainInfoFlowType || chatFlow.Stage != WaitingForDateStage || chatFlow.Extra != "1741" {
+		t.Errorf("expected the flow to be updated in place, got %+v", chatFlow)
+	}
+
+	saved := store.Get(ctx, 42)
+	if saved.Type != TrainInfoFlowType || saved.Stage != WaitingForDateStage || saved.Extra != "1741" {
+		t.Errorf("expected the flow to be saved, got %+v", saved)
+	}
+	if unchanged := store.Get(ctx, 43); unchanged.Type != other.Type || unchanged.Stage != other.Stage || unchanged.Extra != other.Extra {
+		t.Errorf("expected the flow of another chat to be unchanged, got %+v", unchanged)
+	}
+
+	// Empty values must be saved too
+	store.Set(ctx, saved, InitialFlowType, InitialFlowType, "")
+	if reset := store.Get(ctx, 42); reset.Type != InitialFlowType || reset.Stage != InitialFlowType || len(reset.Extra) != 0 {
+		t.Errorf("expected the flow to be reset, got %+v", reset)
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	CommuteAddCallbackQuery         = "CM_ADD"
+	CommutePauseCallbackQuery       = "CM_PAUSE"
+	CommuteDeleteCallbackQuery      = "CM_DEL"
+	CommuteChooseGroupCallbackQuery = "CM_GROUP"
+	CommuteChooseDaysCallbackQuery  = "CM_DAYS"
+
+	WeekdaysMask = 1<<time.Monday | 1<<time.Tuesday | 1<<time.Wednesday | 1<<time.Thursday | 1<<time.Friday
+	WeekendMask  = 1<<time.Saturday | 1<<time.Sunday
+	EveryDayMask = WeekdaysMask | WeekendMask
+
+	chooseCommuteDaysMessage = `On which days do you take this train?
+
+You may also send the days as a message, for example: mon tue fri.`
+)
+
+var (
+	InvalidWeekdays   = fmt.Errorf("invalid weekdays")
+	InvalidTimeWindow = fmt.Errorf("invalid time window")
+)
+
+func FormatWeekdays(mask uint8) string {
+	switch mask {
+	case EveryDayMask:
+		return "every day"
+	case WeekdaysMask:
+		return "Mon–Fri"
+	case WeekendMask:
+		return "Sat–Sun"
+	}
+	days := make([]string, 0, 7)
+	// Start the week on Monday
+	for i := 1; i <= 7; i++ {
+		day := time.Weekday(i % 7)
+		if mask&(1<<day) != 0 {
+			days = append(days, day.String()[:3])
+		}
+	}
+	return strings.Join(days, ", ")
+}
+
+func FormatMinuteOfDay(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+// ParseWeekdays parses a list of day names, such as "mon tue fri" or
+// "monday, friday", into a weekday mask.
+func ParseWeekdays(input string) (uint8, error) {
+	var mask uint8
+	days := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return r == ' ' || r == ',' || r == ';'
+	})
+	for _, day := range days {
+		found := false
+		for i := time.Sunday; i <= time.Saturday; i++ {
+			name := strings.ToLower(i.String())
+			if len(day) >= 2 && strings.HasPrefix(name, day) {
+				mask |= 1 << i
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, InvalidWeekdays
+		}
+	}
+	if mask == 0 {
+		return 0, InvalidWeekdays
+	}
+	return mask, nil
+}
+
+// ParseTimeWindow parses a window such as "07:00-08:30" into minutes since
+// midnight.
+func ParseTimeWindow(input string) (int, int, error) {
+	parts := strings.Split(strings.ReplaceAll(input, "–", "-"), "-")
+	if len(parts) != 2 {
+		return 0, 0, InvalidTimeWindow
+	}
+	parseMinute := func(s string) (int, error) {
+		hm := strings.Split(strings.TrimSpace(s), ":")
+		if len(hm) != 2 {
+			return 0, InvalidTimeWindow
+		}
+		hour, err := strconv.Atoi(hm[0])
+		if err != nil || hour < 0 || hour > 24 {
+			return 0, InvalidTimeWindow
+		}
+		minute, err := strconv.Atoi(hm[1])
+		if err != nil || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+			return 0, InvalidTimeWindow
+		}
+		return hour*60 + minute, nil
+	}
+	start, err := parseMinute(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseMinute(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, InvalidTimeWindow
+	}
+	return start, end, nil
+}
+
+func GetCommuteChooseGroupResponse(trainData *api.TrainResponse) *HandlerResponse {
+	replyButtons := make([][]models.InlineKeyboardButton, 0, len(trainData.Groups))
+	for i, group := range trainData.Groups {
+		replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+			{
+				Text:         fmt.Sprintf("%s ➔ %s", group.Route.From, group.Route.To),
+				CallbackData: fmt.Sprintf(CommuteChooseGroupCallbackQuery+"\x1b%d", i),
+			},
+		})
+	}
+	return &HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text: fmt.Sprintf("Train %s %s contains multiple groups. Please choose one.", trainData.Rank, trainData.Number),
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: replyButtons,
+			},
+		},
+	}
+}
+
+func GetCommuteChooseDaysResponse() *HandlerResponse {
+	button := func(text string, mask uint8) models.InlineKeyboardButton {
+		return models.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: fmt.Sprintf(CommuteChooseDaysCallbackQuery+"\x1b%d", mask),
+		}
+	}
+	return &HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text: chooseCommuteDaysMessage,
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: [][]models.InlineKeyboardButton{
+					{
+						button("Mon–Fri", WeekdaysMask),
+						button("Every day", EveryDayMask),
+						button("Sat–Sun", WeekendMask),
+					},
+				},
+			},
+		},
+	}
+}
@@ -2,10 +2,10 @@ package handlers
 
 import (
 	"context"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
 	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"strconv"
 	"strings"
@@ -17,32 +17,62 @@ import (
 )
 
 const (
-	TrainInfoChooseDateCallbackQuery  = "TI_CHOOSE_DATE"
-	TrainInfoChooseGroupCallbackQuery = "TI_CHOOSE_GROUP"
-	TrainInfoSubscribeCallbackQuery   = "TI_SUB"
-	TrainInfoUnsubscribeCallbackQuery = "TI_UNSUB"
+	TrainInfoChooseDateCallbackQuery      = "TI_CHOOSE_DATE"
+	TrainInfoChooseGroupCallbackQuery     = "TI_CHOOSE_GROUP"
+	TrainInfoSubscribeCallbackQuery       = "TI_SUB"
+	TrainInfoUnsubscribeCallbackQuery     = "TI_UNSUB"
+	TrainInfoNotificationsCallbackQuery   = "TI_NTF"
+	TrainInfoNotificationSetCallbackQuery = "TI_NTF_SET"
+	TrainInfoStopsCallbackQuery           = "TI_STOPS"
+	TrainInfoChooseFromCallbackQuery      = "TI_FROM"
+	TrainInfoChooseToCallbackQuery        = "TI_TO"
+	TrainInfoStopsPageCallbackQuery       = "TI_STOPS_PAGE"
 
 	viewInKaiBaseUrl = "https://kai.infotren.dcdev.ro/view-train.html"
 
-	subscribeButton    = "Subscribe to updates"
-	unsubscribeButton  = "Unsubscribe from updates"
-	viewInWebAppButton = "View in WebApp"
+	subscribeButton     = "Subscribe to updates"
+	unsubscribeButton   = "Unsubscribe from updates"
+	notificationsButton = "Notification settings"
+	stopsButton         = "Choose my stations"
+	viewInWebAppButton  = "View in WebApp"
 )
 
+// How long after the scheduled arrival at the last station a tracked message
+// keeps being updated, unless configured otherwise
+const DefaultUnsubscribeGracePeriod = time.Hour * 6
+
 const (
 	TrainInfoResponseButtonExcludeSub = iota
 	TrainInfoResponseButtonIncludeSub
 	TrainInfoResponseButtonIncludeUnsub
 )
 
-func HandleTrainNumberCommand(ctx context.Context, trainNumber string, date time.Time, groupIndex int, isSubscribed bool) (*HandlerResponse, bool) {
-	trainData, err := api.GetTrain(ctx, trainNumber, date)
+// TrainStops are the stations a user boards and alights at. Empty names mean
+// the first and last station of the group.
+type TrainStops struct {
+	From string
+	To   string
+}
+
+// HandleTrainNumberCommand renders a train run. gracePeriod is how long after
+// the scheduled arrival at the last station it may still be tracked.
+func HandleTrainNumberCommand(ctx context.Context, source api.TrainDataSource, trainNumber string, date time.Time, groupIndex int, isSubscribed bool, gracePeriod time.Duration) (*HandlerResponse, bool) {
+	return HandleTrainNumberCommandWithStops(ctx, source, trainNumber, date, groupIndex, isSubscribed, TrainStops{}, gracePeriod)
+}
+
+func HandleTrainNumberCommandWithStops(ctx context.Context, source api.TrainDataSource, trainNumber string, date time.Time, groupIndex int, isSubscribed bool, stops TrainStops, gracePeriod time.Duration) (*HandlerResponse, bool) {
+	trainData, err := source.GetTrain(ctx, trainNumber, date)
+	return RenderTrainResponse(ctx, trainData, err, trainNumber, date, groupIndex, isSubscribed, stops, gracePeriod)
+}
 
+// RenderTrainResponse renders the result of looking up a train, so that the
+// same lookup can be rendered for several messages.
+func RenderTrainResponse(ctx context.Context, trainData *api.TrainResponse, err error, trainNumber string, date time.Time, groupIndex int, isSubscribed bool, stops TrainStops, gracePeriod time.Duration) (*HandlerResponse, bool) {
 	switch {
 	case err == nil:
 		break
 	case errors.Is(err, api.TrainNotFound):
-		log.Printf("ERROR: In handle train number: %s", err.Error())
+		logging.FromContext(ctx).Error("In handle train number", logging.Err(err), logging.TrainNumberKey, trainNumber)
 		return &HandlerResponse{
 			Message: &bot.SendMessageParams{
 				Text: fmt.Sprintf("The train %s was not found.", trainNumber),
@@ -54,7 +84,7 @@ func HandleTrainNumberCommand(ctx context.Context, trainNumber string, date time
 			}(),
 		}, false
 	case errors.Is(err, api.ServerError):
-		log.Printf("ERROR: In handle train number: %s", err.Error())
+		logging.FromContext(ctx).Error("In handle train number", logging.Err(err), logging.TrainNumberKey, trainNumber)
 		return &HandlerResponse{
 			Message: &bot.SendMessageParams{
 				Text: fmt.Sprintf("Unknown server error when searching for train %s.", trainNumber),
@@ -66,10 +96,14 @@ func HandleTrainNumberCommand(ctx context.Context, trainNumber string, date time
 			}(),
 		}, false
 	default:
-		log.Printf("ERROR: In handle train number: %s", err.Error())
+		logging.FromContext(ctx).Error("In handle train number", logging.Err(err), logging.TrainNumberKey, trainNumber)
 		return nil, false
 	}
 
+	return renderTrainData(trainData, trainNumber, date, groupIndex, isSubscribed, stops, gracePeriod)
+}
+
+func renderTrainData(trainData *api.TrainResponse, trainNumber string, date time.Time, groupIndex int, isSubscribed bool, stops TrainStops, gracePeriod time.Duration) (*HandlerResponse, bool) {
 	if len(trainData.Groups) == 1 {
 		groupIndex = 0
 	}
@@ -83,19 +117,24 @@ func HandleTrainNumberCommand(ctx context.Context, trainNumber string, date time
 		}
 		now := time.Now().In(utils.Location)
 		midnightYesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, utils.Location)
-		lastStation := trainData.Groups[groupIndex].
-			Stations[len(trainData.Groups[groupIndex].Stations)-1]
-		if now.After(lastStation.Arrival.
-			ScheduleTime.Add(time.Hour * 6)) {
-			return true
+		group := &trainData.Groups[groupIndex]
+		// Stop updating once the user's destination is reached, not only at the terminus
+		lastStationIdx := len(group.Stations) - 1
+		if toIdx := FindStationIndex(group, stops.To); toIdx > 0 {
+			lastStationIdx = toIdx
 		}
-		if trainData.Groups[groupIndex].
-			Status != nil && trainData.Groups[groupIndex].
-			Status.Station == lastStation.Name &&
-			trainData.Groups[groupIndex].Status.
-				State == "arrival" {
+		lastStation := group.Stations[lastStationIdx]
+		if lastStation.Arrival != nil && now.After(lastStation.Arrival.
+			ScheduleTime.Add(gracePeriod)) {
 			return true
 		}
+		if group.Status != nil {
+			statusIdx := FindStationIndex(group, group.Status.Station)
+			if statusIdx > lastStationIdx ||
+				(statusIdx == lastStationIdx && (group.Status.State == "arrival" || lastStationIdx != len(group.Stations)-1)) {
+				return true
+			}
+		}
 		if date.Before(midnightYesterday) {
 			return true
 		}
@@ -242,6 +281,8 @@ func HandleTrainNumberCommand(ctx context.Context, trainNumber string, date time
 			messageText.WriteString("\n")
 		}
 
+		writeTrainStops(&messageText, group, stops)
+
 		message.Text = messageText.String()
 		message.Entities = []models.MessageEntity{
 			{
@@ -272,6 +313,7 @@ func HandleTrainNumberCommand(ctx context.Context, trainNumber string, date time
 	return &HandlerResponse{
 		Message:           &message,
 		ShouldUnsubscribe: shouldUnsubscribe,
+		TrainData:         trainData,
 	}, true
 }
 
@@ -299,23 +341,115 @@ func GetTrainNumberCommandResponseButtons(trainNumber string, date time.Time, gr
 				Text:         unsubscribeButton,
 				CallbackData: fmt.Sprintf(TrainInfoUnsubscribeCallbackQuery+"\x1b%s\x1b%d\x1b%d", trainNumber, date.Unix(), groupIndex),
 			},
+		}, []models.InlineKeyboardButton{
+			{
+				Text:         notificationsButton,
+				CallbackData: TrainInfoNotificationsCallbackQuery,
+			},
+			{
+				Text:         stopsButton,
+				CallbackData: TrainInfoStopsCallbackQuery,
+			},
 		})
 	}
-	result = append(result, []models.InlineKeyboardButton{
-		{
-			Text: viewInWebAppButton,
-			WebApp: &models.WebAppInfo{
-				URL: func() string {
-					miniAppUrl := *kaiUrl
-					miniAppUrlQuery := miniAppUrl.Query()
-					miniAppUrlQuery.Add("tg", "1")
-					miniAppUrl.RawQuery = miniAppUrlQuery.Encode()
-					return miniAppUrl.String()
-				}(),
-			},
+	lastRow := make([]models.InlineKeyboardButton, 0, 2)
+	if groupIndex != -1 {
+		lastRow = append(lastRow, models.InlineKeyboardButton{
+			Text:         showAllStopsButton,
+			CallbackData: fmt.Sprintf(TrainInfoTimetableCallbackQuery+"\x1b%s\x1b%d\x1b%d", trainNumber, date.Unix(), groupIndex),
+		})
+	}
+	lastRow = append(lastRow, models.InlineKeyboardButton{
+		Text: viewInWebAppButton,
+		WebApp: &models.WebAppInfo{
+			URL: func() string {
+				miniAppUrl := *kaiUrl
+				miniAppUrlQuery := miniAppUrl.Query()
+				miniAppUrlQuery.Add("tg", "1")
+				miniAppUrl.RawQuery = miniAppUrlQuery.Encode()
+				return miniAppUrl.String()
+			}(),
 		},
 	})
+	result = append(result, lastRow)
 	return models.InlineKeyboardMarkup{
 		InlineKeyboard: result,
 	}
 }
+
+// FindStationIndex returns the index of the station with the given name in
+// the group, or -1 if it is not found or name is empty.
+func FindStationIndex(group *api.TrainGroup, name string) int {
+	if len(name) == 0 {
+		return -1
+	}
+	for i := range group.Stations {
+		if group.Stations[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func writeTrainStops(messageText *strings.Builder, group *api.TrainGroup, stops TrainStops) {
+	realTime := func(arrDep *api.TrainArrDep) time.Time {
+		if arrDep.Status != nil {
+			return arrDep.ScheduleTime.Add(time.Minute * time.Duration(arrDep.Status.Delay))
+		}
+		return arrDep.ScheduleTime
+	}
+	delayText := func(arrDep *api.TrainArrDep) string {
+		switch {
+		case arrDep.Status == nil:
+			return ""
+		case arrDep.Status.Cancelled:
+			return ", cancelled"
+		case arrDep.Status.Delay > 0:
+			return fmt.Sprintf(", %d min late", arrDep.Status.Delay)
+		case arrDep.Status.Delay < 0:
+			return fmt.Sprintf(", %d min early", -arrDep.Status.Delay)
+		default:
+			return ", on time"
+		}
+	}
+	platformText := func(station *api.TrainStation) string {
+		if station.Platform == nil {
+			return ""
+		}
+		return fmt.Sprintf(", platform %s", *station.Platform)
+	}
+	timeUntil := func(t time.Time) string {
+		if d := t.Sub(time.Now()); d >= time.Minute {
+			return formatDuration(d)
+		}
+		return "less than 1m"
+	}
+	separated := false
+	writeLine := func(line string) {
+		if !separated {
+			messageText.WriteString("\n")
+			separated = true
+		}
+		messageText.WriteString(line)
+		messageText.WriteString("\n")
+	}
+
+	if fromIdx := FindStationIndex(group, stops.From); fromIdx != -1 && group.Stations[fromIdx].Departure != nil {
+		station := &group.Stations[fromIdx]
+		depTime := realTime(station.Departure)
+		if time.Now().Before(depTime) {
+			writeLine(fmt.Sprintf("Departs from your station %s in %s at %s%s%s", station.Name, timeUntil(depTime), depTime.In(utils.Location).Format("15:04"), platformText(station), delayText(station.Departure)))
+		} else {
+			writeLine(fmt.Sprintf("Departed from your station %s at %s%s", station.Name, depTime.In(utils.Location).Format("15:04"), delayText(station.Departure)))
+		}
+	}
+	if toIdx := FindStationIndex(group, stops.To); toIdx != -1 && group.Stations[toIdx].Arrival != nil {
+		station := &group.Stations[toIdx]
+		arrTime := realTime(station.Arrival)
+		if time.Now().Before(arrTime) {
+			writeLine(fmt.Sprintf("Arrives at your station %s in %s at %s%s%s", station.Name, timeUntil(arrTime), arrTime.In(utils.Location).Format("15:04"), platformText(station), delayText(station.Arrival)))
+		} else {
+			writeLine(fmt.Sprintf("Arrived at your station %s at %s%s", station.Name, arrTime.In(utils.Location).Format("15:04"), delayText(station.Arrival)))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot/models"
+)
+
+// The date of the runs recorded in testdata
+var fixtureDate = time.Date(2024, time.June, 10, 12, 0, 0, 0, utils.Location)
+
+func newFixtureSource() api.TrainDataSource {
+	return api.NewFixtureSource(os.DirFS("testdata"))
+}
+
+func inlineKeyboard(t *testing.T, replyMarkup models.ReplyMarkup) [][]models.InlineKeyboardButton {
+	t.Helper()
+	markup, ok := replyMarkup.(models.InlineKeyboardMarkup)
+	if !ok {
+		t.Fatalf("expected an inline keyboard, got %T", replyMarkup)
+	}
+	return markup.InlineKeyboard
+}
+
+func TestHandleTrainNumberCommand(t *testing.T) {
+	response, ok := HandleTrainNumberCommand(context.Background(), newFixtureSource(), "1741", fixtureDate, 0, false, DefaultUnsubscribeGracePeriod)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+
+	text := response.Message.Text
+	for _, expected := range []string{
+		"Train IR 1741\nBrașov ➔ București Nord\n",
+		"Date: 10.06.2024\n",
+		"Operator: CFR Călători\n",
+		"Status: 5 min late when arriving at București Nord\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected the message to contain %q, got:\n%s", expected, text)
+		}
+	}
+	if len(response.Message.Entities) != 1 || response.Message.Entities[0].Offset != 6 || response.Message.Entities[0].Length != len("IR 1741") {
+		t.Errorf("expected the train name to be bold, got %+v", response.Message.Entities)
+	}
+	if response.TrainData == nil || response.TrainData.Number != "1741" {
+		t.Errorf("expected the train data to be returned, got %+v", response.TrainData)
+	}
+	// The run is long over
+	if !response.ShouldUnsubscribe {
+		t.Error("expected ShouldUnsubscribe for a past run")
+	}
+}
+
+func TestHandleTrainNumberCommandChooseGroup(t *testing.T) {
+	response, ok := HandleTrainNumberCommand(context.Background(), newFixtureSource(), "3001", fixtureDate, -1, false, DefaultUnsubscribeGracePeriod)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+
+	if expected := "Train R 3001 contains multiple groups. Please choose one."; response.Message.Text != expected {
+		t.Errorf("expected %q, got %q", expected, response.Message.Text)
+	}
+	if response.ShouldUnsubscribe {
+		t.Error("expected no ShouldUnsubscribe before a group is chosen")
+	}
+	keyboard := inlineKeyboard(t, response.Message.ReplyMarkup)
+	// One row per group and the WebApp link
+	if len(keyboard) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(keyboard))
+	}
+	for i, route := range []string{"Ploiești Vest ➔ Brașov", "Ploiești Vest ➔ Buzău"} {
+		button := keyboard[i][0]
+		if button.Text != route {
+			t.Errorf("expected group %d to be %q, got %q", i, route, button.Text)
+		}
+		expectedData := fmt.Sprintf(TrainInfoChooseGroupCallbackQuery+"\x1b3001\x1b%d\x1b%d", fixtureDate.Unix(), i)
+		if button.CallbackData != expectedData {
+			t.Errorf("expected group %d callback %q, got %q", i, expectedData, button.CallbackData)
+		}
+	}
+}
+
+func TestHandleTrainNumberCommandNotFound(t *testing.T) {
+	response, ok := HandleTrainNumberCommand(context.Background(), newFixtureSource(), "9999", fixtureDate, 0, true, DefaultUnsubscribeGracePeriod)
+	if ok {
+		t.Error("expected the lookup to fail")
+	}
+	if response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v", response)
+	}
+	if expected := "The train 9999 was not found."; response.Message.Text != expected {
+		t.Errorf("expected %q, got %q", expected, response.Message.Text)
+	}
+	if !response.ShouldUnsubscribe {
+		t.Error("expected ShouldUnsubscribe for a missing past run")
+	}
+}
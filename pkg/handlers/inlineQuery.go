@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// Train status changes quickly, so don't let Telegram cache answers for long
+	inlineQueryCacheTime = 30
+)
+
+// HandleTrainInlineQuery answers inline queries of the form "<train number> [date]"
+// with one article per train group.
+func HandleTrainInlineQuery(ctx context.Context, source api.TrainDataSource, query string, gracePeriod time.Duration) *HandlerResponse {
+	response := &HandlerResponse{
+		InlineQueryAnswer: &bot.AnswerInlineQueryParams{
+			Results:   []models.InlineQueryResult{},
+			CacheTime: inlineQueryCacheTime,
+		},
+	}
+
+	queryParams := strings.Fields(query)
+	if len(queryParams) == 0 {
+		return response
+	}
+	trainNumber := queryParams[0]
+	date := time.Now()
+	if len(queryParams) > 1 {
+		parsedDate, err := utils.ParseDate(queryParams[1])
+		if err != nil {
+			return response
+		}
+		date = parsedDate
+	}
+
+	trainData, err := source.GetTrain(ctx, trainNumber, date)
+	if err != nil {
+		logging.FromContext(ctx).Debug("In handle inline query", logging.Err(err), logging.TrainNumberKey, trainNumber)
+		return response
+	}
+
+	for i, group := range trainData.Groups {
+		groupResponse, ok := renderTrainData(trainData, trainNumber, date, i, false, TrainStops{}, gracePeriod)
+		if !ok || groupResponse == nil || groupResponse.Message == nil {
+			continue
+		}
+		message := groupResponse.Message
+		response.InlineQueryAnswer.Results = append(response.InlineQueryAnswer.Results, &models.InlineQueryResultArticle{
+			ID:          fmt.Sprintf("%s-%d-%d", trainData.Number, date.Unix(), i),
+			Title:       fmt.Sprintf("%s %s: %s ➔ %s", trainData.Rank, trainData.Number, group.Route.From, group.Route.To),
+			Description: fmt.Sprintf("Date: %s", trainData.Date),
+			InputMessageContent: &models.InputTextMessageContent{
+				MessageText:           message.Text,
+				ParseMode:             message.ParseMode,
+				Entities:              message.Entities,
+				DisableWebPagePreview: message.DisableWebPagePreview,
+			},
+			ReplyMarkup: GetInlineCompatibleMarkup(message.ReplyMarkup),
+		})
+	}
+
+	return response
+}
+
+// GetInlineCompatibleMarkup adapts a keyboard for messages sent via inline mode.
+// Web App buttons only work in private chats, so they are turned into plain links.
+// Only the subscription buttons are kept from the callback buttons, since the
+// other ones need a chat with the bot.
+func GetInlineCompatibleMarkup(markup models.ReplyMarkup) models.ReplyMarkup {
+	keyboard, ok := markup.(models.InlineKeyboardMarkup)
+	if !ok {
+		return nil
+	}
+	result := make([][]models.InlineKeyboardButton, 0, len(keyboard.InlineKeyboard))
+	for _, row := range keyboard.InlineKeyboard {
+		newRow := make([]models.InlineKeyboardButton, 0, len(row))
+		for _, button := range row {
+			switch {
+			case button.WebApp != nil:
+				linkUrl, err := url.Parse(button.WebApp.URL)
+				if err != nil {
+					continue
+				}
+				linkUrlQuery := linkUrl.Query()
+				linkUrlQuery.Del("tg")
+				linkUrl.RawQuery = linkUrlQuery.Encode()
+				newRow = append(newRow, models.InlineKeyboardButton{
+					Text: button.Text,
+					URL:  linkUrl.String(),
+				})
+			case len(button.CallbackData) == 0,
+				strings.HasPrefix(button.CallbackData, TrainInfoSubscribeCallbackQuery+"\x1b"),
+				strings.HasPrefix(button.CallbackData, TrainInfoUnsubscribeCallbackQuery+"\x1b"):
+				newRow = append(newRow, button)
+			}
+		}
+		if len(newRow) > 0 {
+			result = append(result, newRow)
+		}
+	}
+	return models.InlineKeyboardMarkup{
+		InlineKeyboard: result,
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	StationPickCallbackQuery = "ST_PICK"
+
+	maxStationSuggestions = 8
+)
+
+// ResolveStation turns free text into a station known by the scraper. Its
+// LinkName is meant for requests to the scraper, and its Name for users. If
+// the input is ambiguous or unknown, the response asks the user to pick a
+// station or try again.
+func ResolveStation(ctx context.Context, stations *api.StationIndex, input string) (*api.IndexedStation, *HandlerResponse) {
+	input = strings.TrimSpace(input)
+	if stations.Len() == 0 {
+		// No station list available, let the scraper decide
+		return &api.IndexedStation{
+			Name:     input,
+			LinkName: input,
+		}, nil
+	}
+
+	matches := stations.Search(input, maxStationSuggestions)
+	switch {
+	case len(matches) == 0:
+		logging.FromContext(ctx).Debug("No station matches", logging.MessageText(input))
+		return nil, &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: fmt.Sprintf("No station named \"%s\" was found. Please try again.", input),
+			},
+		}
+	case len(matches) == 1 || matches[0].Score == 0 || matches[0].Score < matches[1].Score:
+		return &matches[0].Station, nil
+	}
+
+	replyButtons := make([][]models.InlineKeyboardButton, 0, len(matches))
+	for _, match := range matches {
+		replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+			{
+				Text:         match.Station.Name,
+				CallbackData: StationPickCallbackQuery + "\x1b" + match.Station.LinkName,
+			},
+		})
+	}
+	return nil, &HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text: fmt.Sprintf("Several stations match \"%s\". Please choose one.", input),
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: replyButtons,
+			},
+		},
+	}
+}
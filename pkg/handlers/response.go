@@ -1,6 +1,9 @@
 package handlers
 
-import "github.com/go-telegram/bot"
+import (
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"github.com/go-telegram/bot"
+)
 
 type HandlerResponse struct {
 	Message                 *bot.SendMessageParams
@@ -8,8 +11,11 @@ type HandlerResponse struct {
 	CallbackAnswer          *bot.AnswerCallbackQueryParams
 	MessageEdits            []*bot.EditMessageTextParams
 	MessageMarkupEdits      []*bot.EditMessageReplyMarkupParams
+	InlineQueryAnswer       *bot.AnswerInlineQueryParams
 	ShouldUnsubscribe       bool
-	Injected                struct {
+	// The data the response was rendered from, if any
+	TrainData *api.TrainResponse
+	Injected  struct {
 		ChatId    int64
 		MessageId int
 	}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	RouteChooseDateCallbackQuery = "RT_DATE"
+	RouteTrainCallbackQuery      = "RT_TRAIN"
+
+	// Telegram limits both the message length and the number of inline buttons
+	maxRouteItineraries = 15
+)
+
+// HandleRouteCommand searches trains between two stations, given by their
+// link names. The station names shown come from stations, if known.
+func HandleRouteCommand(ctx context.Context, source api.TrainDataSource, stations *api.StationIndex, from string, to string, date time.Time) (*HandlerResponse, bool) {
+	itineraries, err := source.GetItineraries(ctx, from, to, date)
+	fromName := stations.DisplayName(from)
+	toName := stations.DisplayName(to)
+
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, api.StationNotFound):
+		logging.FromContext(ctx).Error("In handle route", logging.Err(err))
+		return &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: fmt.Sprintf("The station %s or %s was not found.", fromName, toName),
+			},
+		}, false
+	case errors.Is(err, api.ServerError):
+		logging.FromContext(ctx).Error("In handle route", logging.Err(err))
+		return &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: fmt.Sprintf("Unknown server error when searching for trains from %s to %s.", fromName, toName),
+			},
+		}, false
+	default:
+		logging.FromContext(ctx).Error("In handle route", logging.Err(err))
+		return nil, false
+	}
+
+	truncated := len(itineraries) > maxRouteItineraries
+	if truncated {
+		itineraries = itineraries[:maxRouteItineraries]
+	}
+
+	messageText := strings.Builder{}
+	messageText.WriteString("Trains from ")
+	fromOffset := utils.UTF16Len(messageText.String())
+	messageText.WriteString(fromName)
+	messageText.WriteString(" to ")
+	toOffset := utils.UTF16Len(messageText.String())
+	messageText.WriteString(toName)
+	messageText.WriteString(fmt.Sprintf("\nDate: %s\n", date.In(utils.Location).Format("02.01.2006")))
+
+	if len(itineraries) == 0 {
+		messageText.WriteString("\nNo trains found for this route.\n")
+	}
+
+	replyButtons := make([][]models.InlineKeyboardButton, 0, len(itineraries))
+	for i, itinerary := range itineraries {
+		if len(itinerary.Trains) == 0 {
+			continue
+		}
+		first := itinerary.Trains[0]
+		last := itinerary.Trains[len(itinerary.Trains)-1]
+
+		messageText.WriteString(fmt.Sprintf("\n%d. %s ➔ %s (%s)", i+1, first.DepartureDate.In(utils.Location).Format("15:04"), last.ArrivalDate.In(utils.Location).Format("15:04"), formatDuration(last.ArrivalDate.Sub(first.DepartureDate))))
+		switch changes := len(itinerary.Trains) - 1; changes {
+		case 0:
+			messageText.WriteString(", direct\n")
+		case 1:
+			messageText.WriteString(", 1 change\n")
+		default:
+			messageText.WriteString(fmt.Sprintf(", %d changes\n", changes))
+		}
+
+		buttonRow := make([]models.InlineKeyboardButton, 0, len(itinerary.Trains))
+		for _, train := range itinerary.Trains {
+			messageText.WriteString(fmt.Sprintf("    %s %s: %s %s ➔ %s %s\n", train.TrainRank, train.TrainNumber, train.From, train.DepartureDate.In(utils.Location).Format("15:04"), train.To, train.ArrivalDate.In(utils.Location).Format("15:04")))
+			buttonRow = append(buttonRow, models.InlineKeyboardButton{
+				Text:         fmt.Sprintf("%d: %s %s", i+1, train.TrainRank, train.TrainNumber),
+				CallbackData: fmt.Sprintf(RouteTrainCallbackQuery+"\x1b%s\x1b%d", train.TrainNumber, train.DepartureDate.Unix()),
+			})
+		}
+		replyButtons = append(replyButtons, buttonRow)
+	}
+	if truncated {
+		messageText.WriteString(fmt.Sprintf("\nOnly the first %d results are shown.\n", maxRouteItineraries))
+	}
+
+	message := bot.SendMessageParams{
+		Text: messageText.String(),
+		Entities: []models.MessageEntity{
+			{
+				Type:   models.MessageEntityTypeBold,
+				Offset: fromOffset,
+				Length: utils.UTF16Len(fromName),
+			},
+			{
+				Type:   models.MessageEntityTypeBold,
+				Offset: toOffset,
+				Length: utils.UTF16Len(toName),
+			},
+		},
+	}
+	if len(replyButtons) > 0 {
+		message.ReplyMarkup = models.InlineKeyboardMarkup{
+			InlineKeyboard: replyButtons,
+		}
+	}
+
+	return &HandlerResponse{
+		Message: &message,
+	}, true
+}
+
+// HandleRouteTrainCommand shows a train of an itinerary, given when it
+// departs from the station where the leg starts.
+func HandleRouteTrainCommand(ctx context.Context, source api.TrainDataSource, trainNumber string, departure time.Time, gracePeriod time.Duration) (*HandlerResponse, bool) {
+	return HandleTrainNumberCommand(ctx, source, trainNumber, legTrainDate(ctx, source, trainNumber, departure), -1, false, gracePeriod)
+}
+
+// legTrainDate returns the date the train left its first station, which is
+// the day before the leg for night trains boarded after midnight.
+func legTrainDate(ctx context.Context, source api.TrainDataSource, trainNumber string, departure time.Time) time.Time {
+	date, ok := TrainRunDate(ctx, source, trainNumber, departure, func(scheduled time.Time) bool {
+		return scheduled.Equal(departure)
+	})
+	if !ok {
+		return departure
+	}
+	return date
+}
+
+// TrainRunDate returns the date the train left its first station, for the run
+// that departs from one of its stations at a time accepted by departs. The
+// runs that start on the day of day and on the day before are tried, since a
+// night train may be boarded after midnight.
+func TrainRunDate(ctx context.Context, source api.TrainDataSource, trainNumber string, day time.Time, departs func(time.Time) bool) (time.Time, bool) {
+	local := day.In(utils.Location)
+	for _, days := range []int{0, -1} {
+		// Same convention as utils.ParseDate
+		date := time.Date(local.Year(), local.Month(), local.Day()+days, 12, 0, 0, 0, utils.Location)
+		trainData, err := source.GetTrain(ctx, trainNumber, date)
+		if err == nil && trainDepartsAt(trainData, departs) {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func trainDepartsAt(trainData *api.TrainResponse, departs func(time.Time) bool) bool {
+	for _, group := range trainData.Groups {
+		for _, station := range group.Stations {
+			if station.Departure != nil && departs(station.Departure.ScheduleTime) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func formatDuration(d time.Duration) string {
+	if d/time.Hour >= 1 {
+		return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
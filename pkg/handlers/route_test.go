@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/database"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+)
+
+func newFixtureStationIndex(t *testing.T, source api.TrainDataSource) *api.StationIndex {
+	t.Helper()
+	db, err := database.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stations, err := api.LoadStationIndex(context.Background(), source, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stations
+}
+
+func TestHandleRouteCommand(t *testing.T) {
+	source := newFixtureSource()
+	stations := newFixtureStationIndex(t, source)
+	response, ok := HandleRouteCommand(context.Background(), source, stations, "Brasov", "Bucuresti-Nord", fixtureDate)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+
+	expectedText := "Trains from Brașov to București Nord\nDate: 10.06.2024\n" +
+		"\n1. 07:00 ➔ 10:00 (3h0m), direct\n" +
+		"    IR 1741: Brașov 07:00 ➔ București Nord 10:00\n" +
+		"\n2. 09:30 ➔ 13:00 (3h30m), 1 change\n" +
+		"    R 3002: Brașov 09:30 ➔ Ploiești Vest 11:50\n" +
+		"    R 3010: Ploiești Vest 12:05 ➔ București Nord 13:00\n"
+	if response.Message.Text != expectedText {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedText, response.Message.Text)
+	}
+	entities := response.Message.Entities
+	if len(entities) != 2 ||
+		entities[0].Offset != utils.UTF16Len("Trains from ") || entities[0].Length != utils.UTF16Len("Brașov") ||
+		entities[1].Offset != utils.UTF16Len("Trains from Brașov to ") || entities[1].Length != utils.UTF16Len("București Nord") {
+		t.Errorf("expected the station names to be bold, got %+v", entities)
+	}
+
+	keyboard := inlineKeyboard(t, response.Message.ReplyMarkup)
+	if len(keyboard) != 2 || len(keyboard[0]) != 1 || len(keyboard[1]) != 2 {
+		t.Fatalf("expected a row per itinerary and a button per train, got %+v", keyboard)
+	}
+	legDeparture := time.Date(2024, time.June, 10, 12, 5, 0, 0, utils.Location)
+	expectedData := fmt.Sprintf(RouteTrainCallbackQuery+"\x1b3010\x1b%d", legDeparture.Unix())
+	if button := keyboard[1][1]; button.Text != "2: R 3010" || button.CallbackData != expectedData {
+		t.Errorf("expected %q with callback %q, got %q with %q", "2: R 3010", expectedData, button.Text, button.CallbackData)
+	}
+}
+
+func TestHandleRouteCommandNotFound(t *testing.T) {
+	source := newFixtureSource()
+	stations := newFixtureStationIndex(t, source)
+	response, ok := HandleRouteCommand(context.Background(), source, stations, "Brasov", "Cluj-Napoca", fixtureDate)
+	if ok {
+		t.Error("expected the search to fail")
+	}
+	if response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v", response)
+	}
+	// Known stations are shown by name, unknown ones as given
+	if expected := "The station Brașov or Cluj-Napoca was not found."; response.Message.Text != expected {
+		t.Errorf("expected %q, got %q", expected, response.Message.Text)
+	}
+}
+
+func TestHandleRouteTrainCommand(t *testing.T) {
+	departure := time.Date(2024, time.June, 10, 7, 42, 0, 0, utils.Location)
+	response, ok := HandleRouteTrainCommand(context.Background(), newFixtureSource(), "1741", departure, DefaultUnsubscribeGracePeriod)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+	if response.TrainData == nil || response.TrainData.Number != "1741" {
+		t.Errorf("expected train 1741, got %+v", response.TrainData)
+	}
+	// The train has a single group, so it is shown right away
+	keyboard := inlineKeyboard(t, response.Message.ReplyMarkup)
+	origin := time.Date(2024, time.June, 10, 7, 0, 0, 0, utils.Location)
+	expectedData := fmt.Sprintf(TrainInfoTimetableCallbackQuery+"\x1b1741\x1b%d\x1b0", origin.Unix())
+	lastRow := keyboard[len(keyboard)-1]
+	if lastRow[0].CallbackData != expectedData {
+		t.Errorf("expected callback %q, got %q", expectedData, lastRow[0].CallbackData)
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	StationInfoChooseKindCallbackQuery   = "SI_KIND"
+	StationInfoChooseWindowCallbackQuery = "SI_WIN"
+
+	StationInfoArrivals   = "arr"
+	StationInfoDepartures = "dep"
+
+	// Telegram limits both the message length and the number of inline buttons
+	maxStationBoardRows = 30
+)
+
+func HandleStationInfoCommand(ctx context.Context, source api.TrainDataSource, stationName string, kind string, from time.Time, until time.Time) (*HandlerResponse, bool) {
+	stationData, err := source.GetStation(ctx, stationName, from)
+
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, api.StationNotFound):
+		logging.FromContext(ctx).Error("In handle station info", logging.Err(err))
+		return &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: fmt.Sprintf("The station %s was not found.", stationName),
+			},
+		}, false
+	case errors.Is(err, api.ServerError):
+		logging.FromContext(ctx).Error("In handle station info", logging.Err(err))
+		return &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: fmt.Sprintf("Unknown server error when searching for station %s.", stationName),
+			},
+		}, false
+	default:
+		logging.FromContext(ctx).Error("In handle station info", logging.Err(err))
+		return nil, false
+	}
+
+	entries := stationData.Departures
+	if kind == StationInfoArrivals {
+		entries = stationData.Arrivals
+	}
+	rows := make([]api.StationArrDep, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Time.Before(from) || !entry.Time.Before(until) {
+			continue
+		}
+		rows = append(rows, entry)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Time.Before(rows[j].Time)
+	})
+	truncated := len(rows) > maxStationBoardRows
+	if truncated {
+		rows = rows[:maxStationBoardRows]
+	}
+
+	messageText := strings.Builder{}
+	if kind == StationInfoArrivals {
+		messageText.WriteString("Arrivals at ")
+	} else {
+		messageText.WriteString("Departures from ")
+	}
+	boldOffset := utils.UTF16Len(messageText.String())
+	messageText.WriteString(stationData.StationName)
+	boldLength := utils.UTF16Len(stationData.StationName)
+	messageText.WriteString(fmt.Sprintf("\n%s – %s\n\n", from.In(utils.Location).Format("02.01.2006 15:04"), until.In(utils.Location).Format("02.01.2006 15:04")))
+
+	if len(rows) == 0 {
+		messageText.WriteString("No trains found in this interval.\n")
+	}
+
+	replyButtons := make([][]models.InlineKeyboardButton, 0, len(rows))
+	for _, row := range rows {
+		messageText.WriteString(row.Time.In(utils.Location).Format("15:04"))
+		if row.Status != nil {
+			switch {
+			case row.Status.Cancelled:
+				messageText.WriteString(" ❌")
+			case row.Status.Delay > 0:
+				messageText.WriteString(fmt.Sprintf(" (+%d)", row.Status.Delay))
+			case row.Status.Delay < 0:
+				messageText.WriteString(fmt.Sprintf(" (%d)", row.Status.Delay))
+			}
+		}
+		messageText.WriteString(fmt.Sprintf(" %s %s", row.Train.Rank, row.Train.Number))
+		if len(row.Train.Route) > 0 {
+			if kind == StationInfoArrivals {
+				messageText.WriteString(fmt.Sprintf(" from %s", row.Train.Route[0]))
+			} else {
+				messageText.WriteString(fmt.Sprintf(" ➔ %s", row.Train.Route[len(row.Train.Route)-1]))
+			}
+		}
+		if row.Status != nil && row.Status.Platform != nil {
+			messageText.WriteString(fmt.Sprintf(", platform %s", *row.Status.Platform))
+		}
+		messageText.WriteString("\n")
+
+		trainDate := row.Train.DepartureDate
+		if trainDate.IsZero() {
+			trainDate = row.Time
+		}
+		replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+			{
+				Text:         fmt.Sprintf("%s %s %s", row.Time.In(utils.Location).Format("15:04"), row.Train.Rank, row.Train.Number),
+				CallbackData: fmt.Sprintf(TrainInfoChooseDateCallbackQuery+"\x1b%s\x1b%d", row.Train.Number, trainDate.Unix()),
+			},
+		})
+	}
+	if truncated {
+		messageText.WriteString(fmt.Sprintf("\nOnly the first %d trains are shown. Choose a shorter interval to see the rest.\n", maxStationBoardRows))
+	}
+
+	message := bot.SendMessageParams{
+		Text: messageText.String(),
+		Entities: []models.MessageEntity{
+			{
+				Type:   models.MessageEntityTypeBold,
+				Offset: boldOffset,
+				Length: boldLength,
+			},
+		},
+	}
+	if len(replyButtons) > 0 {
+		message.ReplyMarkup = models.InlineKeyboardMarkup{
+			InlineKeyboard: replyButtons,
+		}
+	}
+
+	return &HandlerResponse{
+		Message: &message,
+	}, true
+}
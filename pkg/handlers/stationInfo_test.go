@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+)
+
+func TestHandleStationInfoCommandDepartures(t *testing.T) {
+	from := time.Date(2024, time.June, 10, 7, 0, 0, 0, utils.Location)
+	until := from.Add(time.Hour * 3)
+	response, ok := HandleStationInfoCommand(context.Background(), newFixtureSource(), "Brasov", StationInfoDepartures, from, until)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+
+	// Sorted by time, without the train leaving after until
+	expectedText := "Departures from Brașov\n10.06.2024 07:00 – 10.06.2024 10:00\n\n" +
+		"07:00 IR 1741 ➔ București Nord, platform 3\n" +
+		"08:15 (+12) IR 1622 ➔ București Nord, platform 4\n" +
+		"09:30 ❌ R 4032 ➔ Zărnești\n"
+	if response.Message.Text != expectedText {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedText, response.Message.Text)
+	}
+	if len(response.Message.Entities) != 1 || response.Message.Entities[0].Offset != utils.UTF16Len("Departures from ") || response.Message.Entities[0].Length != utils.UTF16Len("Brașov") {
+		t.Errorf("expected the station name to be bold, got %+v", response.Message.Entities)
+	}
+
+	keyboard := inlineKeyboard(t, response.Message.ReplyMarkup)
+	if len(keyboard) != 3 {
+		t.Fatalf("expected a button per train, got %d rows", len(keyboard))
+	}
+	// The train left its origin the day before
+	originDeparture := time.Date(2024, time.June, 9, 22, 40, 0, 0, utils.Location)
+	expectedData := fmt.Sprintf(TrainInfoChooseDateCallbackQuery+"\x1b1622\x1b%d", originDeparture.Unix())
+	if button := keyboard[1][0]; button.Text != "08:15 IR 1622" || button.CallbackData != expectedData {
+		t.Errorf("expected %q with callback %q, got %q with %q", "08:15 IR 1622", expectedData, button.Text, button.CallbackData)
+	}
+}
+
+func TestHandleStationInfoCommandArrivals(t *testing.T) {
+	from := time.Date(2024, time.June, 10, 12, 0, 0, 0, utils.Location)
+	until := from.Add(time.Hour * 2)
+	response, ok := HandleStationInfoCommand(context.Background(), newFixtureSource(), "Brasov", StationInfoArrivals, from, until)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+
+	expectedText := "Arrivals at Brașov\n10.06.2024 12:00 – 10.06.2024 14:00\n\n" +
+		"13:05 R 3001 from Ploiești Vest\n"
+	if response.Message.Text != expectedText {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedText, response.Message.Text)
+	}
+}
+
+func TestHandleStationInfoCommandEmptyInterval(t *testing.T) {
+	from := time.Date(2024, time.June, 10, 20, 0, 0, 0, utils.Location)
+	until := from.Add(time.Hour)
+	response, ok := HandleStationInfoCommand(context.Background(), newFixtureSource(), "Brasov", StationInfoDepartures, from, until)
+	if !ok || response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v, %v", response, ok)
+	}
+
+	expectedText := "Departures from Brașov\n10.06.2024 20:00 – 10.06.2024 21:00\n\nNo trains found in this interval.\n"
+	if response.Message.Text != expectedText {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedText, response.Message.Text)
+	}
+	if response.Message.ReplyMarkup != nil {
+		t.Errorf("expected no buttons, got %+v", response.Message.ReplyMarkup)
+	}
+}
+
+func TestHandleStationInfoCommandNotFound(t *testing.T) {
+	from := time.Date(2024, time.June, 10, 7, 0, 0, 0, utils.Location)
+	response, ok := HandleStationInfoCommand(context.Background(), newFixtureSource(), "Cluj-Napoca", StationInfoDepartures, from, from.Add(time.Hour))
+	if ok {
+		t.Error("expected the lookup to fail")
+	}
+	if response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v", response)
+	}
+	if expected := "The station Cluj-Napoca was not found."; response.Message.Text != expected {
+		t.Errorf("expected %q, got %q", expected, response.Message.Text)
+	}
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	SubscriptionsUnsubscribeCallbackQuery    = "SUBS_UNSUB"
+	SubscriptionsUnsubscribeAllCallbackQuery = "SUBS_UNSUB_ALL"
+	SubscriptionsPageCallbackQuery           = "SUBS_PAGE"
+	SubscriptionsShowCallbackQuery           = "SUBS_SHOW"
+)
+
+// GetMessageLink returns a link to a message, or an empty string if the chat
+// has no message links (private chats and basic groups).
+func GetMessageLink(chatId int64, messageId int) string {
+	chatIdString := fmt.Sprintf("%d", chatId)
+	if !strings.HasPrefix(chatIdString, "-100") {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(chatIdString, "-100"), messageId)
+}
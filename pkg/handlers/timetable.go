@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	TrainInfoTimetableCallbackQuery = "TI_ALL"
+
+	// Keeps each page well below the message length limit
+	timetableStationsPerPage = 15
+
+	showAllStopsButton = "Show all stops"
+	PreviousPageButton = "◀ Previous"
+	NextPageButton     = "Next ▶"
+)
+
+// HandleTrainTimetableCommand renders one page of the timetable of a train
+// group. A negative page shows the page containing the next stop.
+func HandleTrainTimetableCommand(ctx context.Context, source api.TrainDataSource, trainNumber string, date time.Time, groupIndex int, page int) (*HandlerResponse, bool) {
+	trainData, err := source.GetTrain(ctx, trainNumber, date)
+	if err != nil {
+		logging.FromContext(ctx).Error("In handle train timetable", logging.Err(err), logging.TrainNumberKey, trainNumber)
+		text := fmt.Sprintf("Unknown server error when searching for train %s.", trainNumber)
+		if errors.Is(err, api.TrainNotFound) {
+			text = fmt.Sprintf("The train %s was not found.", trainNumber)
+		}
+		return &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: text,
+			},
+		}, false
+	}
+	if groupIndex < 0 || groupIndex >= len(trainData.Groups) || len(trainData.Groups[groupIndex].Stations) == 0 {
+		return &HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: fmt.Sprintf("The stops of the train %s %s are unknown.", trainData.Rank, trainData.Number),
+			},
+		}, false
+	}
+	group := &trainData.Groups[groupIndex]
+
+	now := time.Now()
+	nextStopIdx := len(group.Stations)
+	for i := range group.Stations {
+		if !isStationPassed(&group.Stations[i], now) {
+			nextStopIdx = i
+			break
+		}
+	}
+
+	pageCount := (len(group.Stations) + timetableStationsPerPage - 1) / timetableStationsPerPage
+	if page < 0 {
+		page = nextStopIdx / timetableStationsPerPage
+	}
+	if page >= pageCount {
+		page = pageCount - 1
+	}
+	first := page * timetableStationsPerPage
+	last := first + timetableStationsPerPage
+	if last > len(group.Stations) {
+		last = len(group.Stations)
+	}
+
+	trainName := fmt.Sprintf("%s %s", trainData.Rank, trainData.Number)
+	messageText := strings.Builder{}
+	messageText.WriteString(fmt.Sprintf("Train %s\n%s ➔ %s\n", trainName, group.Route.From, group.Route.To))
+	messageText.WriteString(fmt.Sprintf("Stops %d–%d of %d\n", first+1, last, len(group.Stations)))
+	for i := first; i < last; i++ {
+		station := &group.Stations[i]
+		marker := "◦"
+		if i < nextStopIdx {
+			marker = "✔"
+		} else if i == nextStopIdx {
+			marker = "▶"
+		}
+		messageText.WriteString(fmt.Sprintf("\n%s %s, km %d\n", marker, station.Name, station.Km))
+		details := make([]string, 0, 4)
+		if station.Arrival != nil {
+			details = append(details, "arr "+formatTimetableTime(station.Arrival))
+		}
+		if station.Departure != nil {
+			details = append(details, "dep "+formatTimetableTime(station.Departure))
+		}
+		if station.StoppingTime != nil && station.Arrival != nil && station.Departure != nil {
+			details = append(details, "stop "+formatStoppingTime(*station.StoppingTime))
+		}
+		if station.Platform != nil && len(*station.Platform) != 0 {
+			details = append(details, "platform "+*station.Platform)
+		}
+		messageText.WriteString("    ")
+		messageText.WriteString(strings.Join(details, ", "))
+		messageText.WriteString("\n")
+	}
+
+	pageButtons := make([]models.InlineKeyboardButton, 0, 2)
+	if page > 0 {
+		pageButtons = append(pageButtons, models.InlineKeyboardButton{
+			Text:         PreviousPageButton,
+			CallbackData: fmt.Sprintf(TrainInfoTimetableCallbackQuery+"\x1b%s\x1b%d\x1b%d\x1b%d", trainNumber, date.Unix(), groupIndex, page-1),
+		})
+	}
+	if page+1 < pageCount {
+		pageButtons = append(pageButtons, models.InlineKeyboardButton{
+			Text:         NextPageButton,
+			CallbackData: fmt.Sprintf(TrainInfoTimetableCallbackQuery+"\x1b%s\x1b%d\x1b%d\x1b%d", trainNumber, date.Unix(), groupIndex, page+1),
+		})
+	}
+
+	message := bot.SendMessageParams{
+		Text: messageText.String(),
+		Entities: []models.MessageEntity{
+			{
+				Type:   models.MessageEntityTypeBold,
+				Offset: 6,
+				Length: utils.UTF16Len(trainName),
+			},
+		},
+	}
+	if len(pageButtons) > 0 {
+		message.ReplyMarkup = models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{pageButtons},
+		}
+	}
+	return &HandlerResponse{
+		Message:   &message,
+		TrainData: trainData,
+	}, true
+}
+
+// isStationPassed reports whether the train already left the station, or
+// arrived at it if it is the terminus.
+func isStationPassed(station *api.TrainStation, now time.Time) bool {
+	arrDep := station.Departure
+	if arrDep == nil {
+		arrDep = station.Arrival
+	}
+	if arrDep == nil {
+		return false
+	}
+	realTime := arrDep.ScheduleTime
+	if arrDep.Status != nil {
+		realTime = realTime.Add(time.Minute * time.Duration(arrDep.Status.Delay))
+	}
+	return now.After(realTime)
+}
+
+// formatTimetableTime shows the scheduled time followed by the real or
+// estimated one, if different.
+func formatTimetableTime(arrDep *api.TrainArrDep) string {
+	scheduled := arrDep.ScheduleTime.In(utils.Location).Format("15:04")
+	switch {
+	case arrDep.Status == nil:
+		return scheduled
+	case arrDep.Status.Cancelled:
+		return scheduled + " ❌ cancelled"
+	case arrDep.Status.Delay == 0:
+		return scheduled + " on time"
+	}
+	realTime := arrDep.ScheduleTime.Add(time.Minute * time.Duration(arrDep.Status.Delay)).In(utils.Location).Format("15:04")
+	if !arrDep.Status.Real {
+		// Delays for upcoming stations are only estimations
+		realTime = "~" + realTime
+	}
+	return fmt.Sprintf("%s ➔ %s (%+d min)", scheduled, realTime, arrDep.Status.Delay)
+}
+
+// formatStoppingTime formats a stopping time given in seconds.
+func formatStoppingTime(seconds int) string {
+	if seconds%60 == 0 {
+		return fmt.Sprintf("%d min", seconds/60)
+	}
+	return fmt.Sprintf("%d s", seconds)
+}
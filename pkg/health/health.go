@@ -0,0 +1,209 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	started = time.Now()
+
+	// Unix nanoseconds of the last time each event happened, 0 if never
+	lastTelegramUpdate   atomic.Int64
+	lastApiSuccess       atomic.Int64
+	lastApiFailure       atomic.Int64
+	lastSubscriptionTick atomic.Int64
+)
+
+// Config holds how old the recorded events may be before a check fails.
+type Config struct {
+	// Long polling returns at least once a minute, even without updates. With
+	// a webhook, updates only arrive when users write, so 0 disables the check.
+	MaxTelegramUpdateAge time.Duration
+	// The subscription loop wakes up at least once a minute
+	MaxSubscriptionTickAge time.Duration
+	// How long the scraper may fail before the bot is not ready. An idle
+	// bot makes no requests, so only failures count.
+	MaxApiFailureDuration time.Duration
+	// Checks that the database can be reached
+	PingDB func(ctx context.Context) error
+}
+
+var DefaultConfig = Config{
+	MaxTelegramUpdateAge:   3 * time.Minute,
+	MaxSubscriptionTickAge: 5 * time.Minute,
+	MaxApiFailureDuration:  5 * time.Minute,
+}
+
+// MarkTelegramUpdate records that updates were received from Telegram, even
+// if there were none to receive.
+func MarkTelegramUpdate() {
+	lastTelegramUpdate.Store(time.Now().UnixNano())
+}
+
+// MarkApiCall records the result of a request to the scraper.
+func MarkApiCall(success bool) {
+	if success {
+		lastApiSuccess.Store(time.Now().UnixNano())
+	} else {
+		lastApiFailure.Store(time.Now().UnixNano())
+	}
+}
+
+// MarkSubscriptionTick records that the subscription loop is running.
+func MarkSubscriptionTick() {
+	lastSubscriptionTick.Store(time.Now().UnixNano())
+}
+
+type CheckResult struct {
+	Name   string     `json:"name"`
+	Ok     bool       `json:"ok"`
+	Detail string     `json:"detail,omitempty"`
+	Last   *time.Time `json:"last,omitempty"`
+}
+
+type Report struct {
+	Ok     bool          `json:"ok"`
+	Checks []CheckResult `json:"checks"`
+}
+
+func loadTime(value *atomic.Int64) *time.Time {
+	nanos := value.Load()
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos)
+	return &t
+}
+
+// checkAge fails if the event didn't happen within maxAge, counting from the
+// start of the process if it never happened.
+func checkAge(name string, value *atomic.Int64, maxAge time.Duration, now time.Time) CheckResult {
+	result := CheckResult{
+		Name: name,
+		Ok:   true,
+		Last: loadTime(value),
+	}
+	since := started
+	if result.Last != nil {
+		since = *result.Last
+	}
+	if age := now.Sub(since); age > maxAge {
+		result.Ok = false
+		if result.Last == nil {
+			result.Detail = fmt.Sprintf("not seen since starting %s ago", age.Round(time.Second))
+		} else {
+			result.Detail = fmt.Sprintf("last seen %s ago", age.Round(time.Second))
+		}
+	}
+	return result
+}
+
+func (config *Config) checkApi(now time.Time) CheckResult {
+	result := CheckResult{
+		Name: "scraper",
+		Ok:   true,
+		Last: loadTime(&lastApiSuccess),
+	}
+	lastFailure := loadTime(&lastApiFailure)
+	if lastFailure == nil || (result.Last != nil && result.Last.After(*lastFailure)) {
+		return result
+	}
+	since := started
+	if result.Last != nil {
+		since = *result.Last
+	}
+	if age := now.Sub(since); age > config.MaxApiFailureDuration {
+		result.Ok = false
+		result.Detail = fmt.Sprintf("failing for %s", age.Round(time.Second))
+	}
+	return result
+}
+
+func (config *Config) checkDB(ctx context.Context) CheckResult {
+	result := CheckResult{
+		Name: "database",
+		Ok:   true,
+	}
+	if config.PingDB == nil {
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := config.PingDB(ctx); err != nil {
+		result.Ok = false
+		result.Detail = err.Error()
+	}
+	return result
+}
+
+// Liveness reports whether the bot's loops are still running. Failing it
+// means the bot is stuck and should be restarted.
+func (config *Config) Liveness(now time.Time) Report {
+	checks := []CheckResult{
+		checkAge("subscriptions", &lastSubscriptionTick, config.MaxSubscriptionTickAge, now),
+	}
+	if config.MaxTelegramUpdateAge > 0 {
+		checks = append(checks, checkAge("telegram", &lastTelegramUpdate, config.MaxTelegramUpdateAge, now))
+	}
+	return newReport(checks...)
+}
+
+// Readiness reports whether the bot can currently serve users: in addition
+// to the liveness checks, the database and the scraper must be reachable.
+func (config *Config) Readiness(ctx context.Context, now time.Time) Report {
+	liveness := config.Liveness(now)
+	return newReport(append(liveness.Checks, config.checkDB(ctx), config.checkApi(now))...)
+}
+
+func newReport(checks ...CheckResult) Report {
+	report := Report{
+		Ok:     true,
+		Checks: checks,
+	}
+	for _, check := range checks {
+		report.Ok = report.Ok && check.Ok
+	}
+	return report
+}
+
+func (config *Config) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, config.Liveness(time.Now()))
+	})
+}
+
+func (config *Config) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, config.Readiness(r.Context(), time.Now()))
+	})
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// PollRecorder is an HTTP client for the bot library that records every
+// successful getUpdates request.
+type PollRecorder struct {
+	Client *http.Client
+}
+
+func (recorder *PollRecorder) Do(req *http.Request) (*http.Response, error) {
+	resp, err := recorder.Client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusOK && path.Base(req.URL.Path) == "getUpdates" {
+		MarkTelegramUpdate()
+	}
+	return resp, err
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Keys of the fields shared by the log records of the whole bot
+const (
+	ChatIdKey      = "chat_id"
+	TrainNumberKey = "train_number"
+	UpdateIdKey    = "update_id"
+	ErrorKey       = "error"
+)
+
+var (
+	// Whether the text sent by users may be logged. Off by default, since
+	// messages can contain personal information.
+	LogMessageText = false
+)
+
+type contextKey struct{}
+
+// ParseLevel accepts debug, info, warn and error, in any case.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return level, fmt.Errorf("unknown log level %q; use one of debug, info, warn, error", name)
+	}
+	return level, nil
+}
+
+func NewLogger(out io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: level,
+	}))
+}
+
+// WithLogger returns a context carrying logger, so that the records of
+// everything done for an update have the same fields.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger added with WithLogger, or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With adds fields to the logger of ctx.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+func Err(err error) slog.Attr {
+	return slog.String(ErrorKey, err.Error())
+}
+
+// MessageText logs the text of a user's message only if allowed with
+// LogMessageText, otherwise just its length.
+func MessageText(text string) slog.Attr {
+	if LogMessageText {
+		return slog.String("text", text)
+	}
+	return slog.Int("text_length", len(text))
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "cfr_bot"
+)
+
+var (
+	// Registry holds all metrics of the bot, along with the Go runtime and
+	// process metrics.
+	Registry = prometheus.NewRegistry()
+
+	factory = promauto.With(Registry)
+
+	UpdatesHandled = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_handled_total",
+		Help:      "Telegram updates handled, by update type and command, callback query method or chat flow.",
+	}, []string{"type", "command"})
+
+	ApiRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of requests to the train data API, by method.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"method"})
+
+	ApiErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Failed requests to the train data API, by method and error class.",
+	}, []string{"method", "class"})
+
+	SubscriptionCheckDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "subscription_check_duration_seconds",
+		Help:      "Duration of checking the trains due in one tick of the subscription scheduler.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	TelegramErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_errors_total",
+		Help:      "Failed Telegram API requests, by method and error kind.",
+	}, []string{"method", "kind"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// GaugeFunc registers a gauge whose value is read from value on every scrape.
+func GaugeFunc(name string, help string, value func() float64) {
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, value)
+}
+
+// CounterFunc registers a counter whose value is read from value on every
+// scrape.
+func CounterFunc(name string, help string, value func() float64) {
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, value)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+)
+
+// InstrumentedSource records the duration and errors of the requests made
+// to a TrainDataSource.
+type InstrumentedSource struct {
+	source api.TrainDataSource
+}
+
+func NewInstrumentedSource(source api.TrainDataSource) *InstrumentedSource {
+	return &InstrumentedSource{
+		source: source,
+	}
+}
+
+func (source *InstrumentedSource) GetTrain(ctx context.Context, trainNumber string, date time.Time) (*api.TrainResponse, error) {
+	start := time.Now()
+	trainData, err := source.source.GetTrain(ctx, trainNumber, date)
+	observeApiRequest("GetTrain", start, err)
+	return trainData, err
+}
+
+func (source *InstrumentedSource) GetStation(ctx context.Context, stationName string, date time.Time) (*api.StationResponse, error) {
+	start := time.Now()
+	stationData, err := source.source.GetStation(ctx, stationName, date)
+	observeApiRequest("GetStation", start, err)
+	return stationData, err
+}
+
+func (source *InstrumentedSource) GetItineraries(ctx context.Context, from string, to string, date time.Time) ([]api.Itinerary, error) {
+	start := time.Now()
+	itineraries, err := source.source.GetItineraries(ctx, from, to, date)
+	observeApiRequest("GetItineraries", start, err)
+	return itineraries, err
+}
+
+func (source *InstrumentedSource) GetStations(ctx context.Context) ([]api.StationListItem, error) {
+	start := time.Now()
+	stations, err := source.source.GetStations(ctx)
+	observeApiRequest("GetStations", start, err)
+	return stations, err
+}
+
+func observeApiRequest(method string, start time.Time, err error) {
+	ApiRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		ApiErrors.WithLabelValues(method, apiErrorClass(err)).Inc()
+	}
+}
+
+func apiErrorClass(err error) string {
+	switch {
+	case errors.Is(err, api.TrainNotFound):
+		return "train_not_found"
+	case errors.Is(err, api.StationNotFound):
+		return "station_not_found"
+	case errors.Is(err, api.ServerError):
+		return "server_error"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
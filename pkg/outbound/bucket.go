@@ -0,0 +1,64 @@
+package outbound
+
+import (
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst operations, refilled at rate
+// operations per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// Set when Telegram asked to wait, see RetryAfter
+	pausedUntil time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	if now.After(bucket.last) {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+		bucket.last = now
+	}
+}
+
+// wait returns how long until a token is available, 0 if one is available now.
+func (bucket *tokenBucket) wait(now time.Time) time.Duration {
+	if now.Before(bucket.pausedUntil) {
+		return bucket.pausedUntil.Sub(now)
+	}
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+func (bucket *tokenBucket) take(now time.Time) {
+	bucket.refill(now)
+	bucket.tokens--
+}
+
+func (bucket *tokenBucket) pause(until time.Time) {
+	if until.After(bucket.pausedUntil) {
+		bucket.pausedUntil = until
+	}
+}
+
+// idle reports whether the bucket is full, so forgetting it changes nothing.
+func (bucket *tokenBucket) idle(now time.Time) bool {
+	bucket.refill(now)
+	return bucket.tokens >= bucket.burst && !now.Before(bucket.pausedUntil)
+}
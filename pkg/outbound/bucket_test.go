@@ -0,0 +1,57 @@
+package outbound
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+	bucket := newTokenBucket(2, 3, now)
+
+	// The whole burst is available right away
+	for i := 0; i < 3; i++ {
+		if wait := bucket.wait(now); wait != 0 {
+			t.Fatalf("token %d: expected no wait, got %v", i, wait)
+		}
+		bucket.take(now)
+	}
+	if wait := bucket.wait(now); wait != 500*time.Millisecond {
+		t.Errorf("expected to wait for the next token, got %v", wait)
+	}
+	if bucket.idle(now) {
+		t.Error("expected an empty bucket not to be idle")
+	}
+
+	now = now.Add(250 * time.Millisecond)
+	if wait := bucket.wait(now); wait != 250*time.Millisecond {
+		t.Errorf("expected half a token to be refilled, got a wait of %v", wait)
+	}
+
+	// Refilling stops at the burst
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		bucket.take(now)
+	}
+	if wait := bucket.wait(now); wait == 0 {
+		t.Error("expected the burst to be the limit")
+	}
+
+	// A pause is respected even if there are tokens
+	now = now.Add(time.Minute)
+	bucket.pause(now.Add(5 * time.Second))
+	bucket.pause(now.Add(time.Second))
+	if wait := bucket.wait(now); wait != 5*time.Second {
+		t.Errorf("expected to wait for the longest pause, got %v", wait)
+	}
+	if bucket.idle(now) {
+		t.Error("expected a paused bucket not to be idle")
+	}
+	now = now.Add(5 * time.Second)
+	if wait := bucket.wait(now); wait != 0 {
+		t.Errorf("expected no wait after the pause, got %v", wait)
+	}
+	if !bucket.idle(now) {
+		t.Error("expected a full bucket to be idle")
+	}
+}
@@ -0,0 +1,383 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/metrics"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+type Priority int
+
+// Stopped is returned for requests made after the dispatcher stopped running.
+var Stopped = fmt.Errorf("dispatcher stopped")
+
+const (
+	// Replies to users, sent before any background work
+	PriorityInteractive Priority = iota
+	// Subscription updates and notifications
+	PriorityBackground
+	priorityCount
+)
+
+// RateLimitConfig follows the limits documented by Telegram: about 30
+// messages per second overall, one per second in a chat and 20 per minute in
+// a group.
+type RateLimitConfig struct {
+	GlobalRate  float64
+	GlobalBurst int
+	ChatRate    float64
+	ChatBurst   int
+	GroupRate   float64
+	GroupBurst  int
+	// How many times a request is retried after a 429 response
+	MaxRetries int
+}
+
+var DefaultRateLimitConfig = RateLimitConfig{
+	GlobalRate:  30,
+	GlobalBurst: 30,
+	ChatRate:    1,
+	ChatBurst:   3,
+	GroupRate:   20.0 / 60,
+	GroupBurst:  3,
+	MaxRetries:  3,
+}
+
+// Stats counts the requests handled by a Dispatcher.
+type Stats struct {
+	Sent        uint64
+	Failed      uint64
+	RateLimited uint64
+	// Requests waiting to be sent
+	Queued int
+}
+
+type job struct {
+	ctx      context.Context
+	method   string
+	chatKey  string
+	isGroup  bool
+	priority Priority
+	call     func(ctx context.Context) error
+	retries  int
+	// Not run before this time, after a 429 response
+	notBefore time.Time
+	done      chan error
+}
+
+// Dispatcher queues the messages sent and edited by the bot, so that
+// Telegram's rate limits are respected. Use Sender to get a handle with the
+// same methods as bot.Bot.
+type Dispatcher struct {
+	tgBot  *bot.Bot
+	config RateLimitConfig
+	now    func() time.Time
+
+	mutex  sync.Mutex
+	queues [priorityCount][]*job
+	global *tokenBucket
+	chats  map[string]*tokenBucket
+	wake   chan struct{}
+	// Set once Run returns; no requests are queued afterwards
+	stopped bool
+
+	sent        atomic.Uint64
+	failed      atomic.Uint64
+	rateLimited atomic.Uint64
+}
+
+func NewDispatcher(tgBot *bot.Bot, config RateLimitConfig) *Dispatcher {
+	return newDispatcher(tgBot, config, time.Now)
+}
+
+func newDispatcher(tgBot *bot.Bot, config RateLimitConfig, now func() time.Time) *Dispatcher {
+	return &Dispatcher{
+		tgBot:  tgBot,
+		config: config,
+		now:    now,
+		global: newTokenBucket(config.GlobalRate, config.GlobalBurst, now()),
+		chats:  map[string]*tokenBucket{},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (dispatcher *Dispatcher) Sender(priority Priority) *Sender {
+	return &Sender{
+		dispatcher: dispatcher,
+		priority:   priority,
+	}
+}
+
+func (dispatcher *Dispatcher) Stats() Stats {
+	dispatcher.mutex.Lock()
+	queued := 0
+	for priority := range dispatcher.queues {
+		queued += len(dispatcher.queues[priority])
+	}
+	dispatcher.mutex.Unlock()
+	return Stats{
+		Sent:        dispatcher.sent.Load(),
+		Failed:      dispatcher.failed.Load(),
+		RateLimited: dispatcher.rateLimited.Load(),
+		Queued:      queued,
+	}
+}
+
+// Run sends the queued requests until ctx is done.
+func (dispatcher *Dispatcher) Run(ctx context.Context) {
+	cleanupTicker := time.NewTicker(time.Minute)
+	defer cleanupTicker.Stop()
+	for {
+		next, wait := dispatcher.next(dispatcher.now())
+		if next != nil {
+			go dispatcher.execute(next)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-dispatcher.wake:
+			timer.Stop()
+		case <-cleanupTicker.C:
+			timer.Stop()
+			dispatcher.cleanup(dispatcher.now())
+		case <-ctx.Done():
+			timer.Stop()
+			dispatcher.failAll(ctx.Err())
+			return
+		}
+	}
+}
+
+func (dispatcher *Dispatcher) enqueue(j *job, front bool) error {
+	dispatcher.mutex.Lock()
+	if dispatcher.stopped {
+		dispatcher.mutex.Unlock()
+		return Stopped
+	}
+	if front {
+		dispatcher.queues[j.priority] = append([]*job{j}, dispatcher.queues[j.priority]...)
+	} else {
+		dispatcher.queues[j.priority] = append(dispatcher.queues[j.priority], j)
+	}
+	dispatcher.mutex.Unlock()
+	select {
+	case dispatcher.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next removes and returns the first job that may run now, by priority and
+// then in order. Otherwise, it returns how long to wait before trying again.
+func (dispatcher *Dispatcher) next(now time.Time) (*job, time.Duration) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	wait := time.Minute
+	if globalWait := dispatcher.global.wait(now); globalWait > 0 {
+		return nil, globalWait
+	}
+	for priority := range dispatcher.queues {
+		queue := dispatcher.queues[priority]
+		for i := 0; i < len(queue); i++ {
+			j := queue[i]
+			if err := j.ctx.Err(); err != nil {
+				queue = append(queue[:i], queue[i+1:]...)
+				i--
+				j.done <- err
+				continue
+			}
+			jobWait := j.notBefore.Sub(now)
+			if len(j.chatKey) != 0 {
+				if chatWait := dispatcher.chatBucket(j, now).wait(now); chatWait > jobWait {
+					jobWait = chatWait
+				}
+			}
+			if jobWait > 0 {
+				if jobWait < wait {
+					wait = jobWait
+				}
+				continue
+			}
+			dispatcher.queues[priority] = append(queue[:i], queue[i+1:]...)
+			dispatcher.global.take(now)
+			if len(j.chatKey) != 0 {
+				dispatcher.chatBucket(j, now).take(now)
+			}
+			return j, 0
+		}
+		dispatcher.queues[priority] = queue
+	}
+	return nil, wait
+}
+
+func (dispatcher *Dispatcher) chatBucket(j *job, now time.Time) *tokenBucket {
+	bucket, ok := dispatcher.chats[j.chatKey]
+	if !ok {
+		if j.isGroup {
+			bucket = newTokenBucket(dispatcher.config.GroupRate, dispatcher.config.GroupBurst, now)
+		} else {
+			bucket = newTokenBucket(dispatcher.config.ChatRate, dispatcher.config.ChatBurst, now)
+		}
+		dispatcher.chats[j.chatKey] = bucket
+	}
+	return bucket
+}
+
+func (dispatcher *Dispatcher) execute(j *job) {
+	err := j.call(j.ctx)
+	if retryAfter := RetryAfter(err); retryAfter > 0 {
+		dispatcher.rateLimited.Add(1)
+		metrics.TelegramErrors.WithLabelValues(j.method, "rate_limited").Inc()
+		if j.retries < dispatcher.config.MaxRetries {
+			logging.FromContext(j.ctx).Warn("Telegram rate limit hit", "method", j.method, "chat", j.chatKey, "retry_after", retryAfter)
+			j.retries++
+			now := dispatcher.now()
+			j.notBefore = now.Add(retryAfter)
+			dispatcher.mutex.Lock()
+			if len(j.chatKey) != 0 {
+				dispatcher.chatBucket(j, now).pause(j.notBefore)
+			} else {
+				dispatcher.global.pause(j.notBefore)
+			}
+			dispatcher.mutex.Unlock()
+			if err := dispatcher.enqueue(j, true); err != nil {
+				dispatcher.failed.Add(1)
+				j.done <- err
+			}
+			return
+		}
+	}
+	switch {
+	case err == nil:
+		dispatcher.sent.Add(1)
+	case ClassifyError(err) == ErrorNotModified:
+		// Nothing to do, so not a failure
+		dispatcher.sent.Add(1)
+		logging.FromContext(j.ctx).Debug("Telegram request didn't modify the message", "method", j.method, "chat", j.chatKey)
+	default:
+		dispatcher.failed.Add(1)
+		metrics.TelegramErrors.WithLabelValues(j.method, ClassifyError(err).String()).Inc()
+		logging.FromContext(j.ctx).Warn("Telegram request failed", "method", j.method, "chat", j.chatKey, logging.Err(err))
+	}
+	j.done <- err
+}
+
+// cleanup forgets the buckets of chats that weren't used recently.
+func (dispatcher *Dispatcher) cleanup(now time.Time) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	for key, bucket := range dispatcher.chats {
+		if bucket.idle(now) {
+			delete(dispatcher.chats, key)
+		}
+	}
+}
+
+func (dispatcher *Dispatcher) failAll(err error) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	dispatcher.stopped = true
+	for priority := range dispatcher.queues {
+		for _, j := range dispatcher.queues[priority] {
+			j.done <- err
+		}
+		dispatcher.queues[priority] = nil
+	}
+}
+
+// do queues call and waits for it to be executed, or for ctx to be done.
+func (dispatcher *Dispatcher) do(ctx context.Context, priority Priority, method string, chatID any, call func(ctx context.Context) error) error {
+	j := newJob(ctx, priority, method, chatID, call)
+	if err := dispatcher.enqueue(j, false); err != nil {
+		return err
+	}
+	select {
+	case err := <-j.done:
+		return err
+	case <-ctx.Done():
+		// A queued job is dropped once the dispatcher sees ctx is done
+		return ctx.Err()
+	}
+}
+
+func newJob(ctx context.Context, priority Priority, method string, chatID any, call func(ctx context.Context) error) *job {
+	j := &job{
+		ctx:      ctx,
+		method:   method,
+		priority: priority,
+		call:     call,
+		done:     make(chan error, 1),
+	}
+	if chatID != nil {
+		j.chatKey = fmt.Sprint(chatID)
+		// Group and channel ids are negative, usernames are only used for
+		// channels
+		switch id := chatID.(type) {
+		case int64:
+			j.isGroup = id < 0
+		case int:
+			j.isGroup = id < 0
+		case string:
+			j.isGroup = true
+		}
+	}
+	return j
+}
+
+// Sender sends requests through a Dispatcher with a certain priority. Its
+// methods have the same signatures as the ones of bot.Bot.
+type Sender struct {
+	dispatcher *Dispatcher
+	priority   Priority
+}
+
+func (sender *Sender) SendMessage(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error) {
+	var message *models.Message
+	err := sender.dispatcher.do(ctx, sender.priority, "sendMessage", params.ChatID, func(ctx context.Context) error {
+		var err error
+		message, err = sender.dispatcher.tgBot.SendMessage(ctx, params)
+		return err
+	})
+	return message, err
+}
+
+func (sender *Sender) EditMessageText(ctx context.Context, params *bot.EditMessageTextParams) (*models.Message, error) {
+	var message *models.Message
+	err := sender.dispatcher.do(ctx, sender.priority, "editMessageText", params.ChatID, func(ctx context.Context) error {
+		var err error
+		message, err = sender.dispatcher.tgBot.EditMessageText(ctx, params)
+		return err
+	})
+	return message, err
+}
+
+func (sender *Sender) EditMessageReplyMarkup(ctx context.Context, params *bot.EditMessageReplyMarkupParams) (*models.Message, error) {
+	var message *models.Message
+	err := sender.dispatcher.do(ctx, sender.priority, "editMessageReplyMarkup", params.ChatID, func(ctx context.Context) error {
+		var err error
+		message, err = sender.dispatcher.tgBot.EditMessageReplyMarkup(ctx, params)
+		return err
+	})
+	return message, err
+}
+
+// AnswerCallbackQuery isn't rate limited, since answers don't send messages
+// and must arrive quickly.
+func (sender *Sender) AnswerCallbackQuery(ctx context.Context, params *bot.AnswerCallbackQueryParams) (bool, error) {
+	return sender.dispatcher.tgBot.AnswerCallbackQuery(ctx, params)
+}
+
+// AnswerInlineQuery isn't rate limited, since answers don't send messages
+// and must arrive quickly.
+func (sender *Sender) AnswerInlineQuery(ctx context.Context, params *bot.AnswerInlineQueryParams) (bool, error) {
+	return sender.dispatcher.tgBot.AnswerInlineQuery(ctx, params)
+}
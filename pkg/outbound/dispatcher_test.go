@@ -0,0 +1,241 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+// fakeSend records the requests it is called for, returning the errors given
+// for each of them in order.
+type fakeSend struct {
+	mutex sync.Mutex
+	calls []string
+	errs  map[string][]error
+}
+
+func (send *fakeSend) call(name string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		send.mutex.Lock()
+		defer send.mutex.Unlock()
+		send.calls = append(send.calls, name)
+		if errs := send.errs[name]; len(errs) > 0 {
+			send.errs[name] = errs[1:]
+			return errs[0]
+		}
+		return nil
+	}
+}
+
+func newTestDispatcher(config RateLimitConfig) (*Dispatcher, *fakeClock) {
+	clock := newFakeClock()
+	return newDispatcher(nil, config, clock.Now), clock
+}
+
+// queueJob adds a request for chatID, which is run by the test instead of Run.
+func queueJob(t *testing.T, dispatcher *Dispatcher, priority Priority, chatID any, call func(ctx context.Context) error) *job {
+	t.Helper()
+	j := newJob(context.Background(), priority, "sendMessage", chatID, call)
+	if err := dispatcher.enqueue(j, false); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// runReady executes the requests that may run now, in the order the
+// dispatcher picks them, and returns how long until the next one may run.
+func runReady(dispatcher *Dispatcher, clock *fakeClock) time.Duration {
+	for {
+		next, wait := dispatcher.next(clock.Now())
+		if next == nil {
+			return wait
+		}
+		dispatcher.execute(next)
+	}
+}
+
+func TestDispatcherRateLimits(t *testing.T) {
+	config := RateLimitConfig{
+		GlobalRate:  4,
+		GlobalBurst: 4,
+		ChatRate:    1,
+		ChatBurst:   1,
+		GroupRate:   20.0 / 60,
+		GroupBurst:  1,
+	}
+	tests := []struct {
+		name          string
+		chatIDs       []any
+		expectedCalls []string
+		expectedWait  time.Duration
+	}{
+		{"per chat", []any{int64(1), int64(1), int64(2)}, []string{"0", "2"}, time.Second},
+		{"per group", []any{int64(-1001), int64(-1001)}, []string{"0"}, 3 * time.Second},
+		{"channel usernames are groups", []any{"@channel", "@channel"}, []string{"0"}, 3 * time.Second},
+		{"global", []any{int64(1), int64(2), int64(3), int64(4), int64(5)}, []string{"0", "1", "2", "3"}, 250 * time.Millisecond},
+		// Requests without a chat only use the global bucket
+		{"no chat", []any{nil, nil}, []string{"0", "1"}, time.Minute},
+	}
+	for _, test := range tests {
+		dispatcher, clock := newTestDispatcher(config)
+		send := &fakeSend{}
+		for i, chatID := range test.chatIDs {
+			queueJob(t, dispatcher, PriorityBackground, chatID, send.call(fmt.Sprint(i)))
+		}
+		wait := runReady(dispatcher, clock)
+		if fmt.Sprint(send.calls) != fmt.Sprint(test.expectedCalls) {
+			t.Errorf("%s: expected the calls %v, got %v", test.name, test.expectedCalls, send.calls)
+		}
+		if wait != test.expectedWait {
+			t.Errorf("%s: expected to wait %v, got %v", test.name, test.expectedWait, wait)
+		}
+
+		// All of them are sent eventually
+		clock.Advance(wait)
+		runReady(dispatcher, clock)
+		if len(send.calls) != len(test.chatIDs) {
+			t.Errorf("%s: expected %d calls after waiting, got %v", test.name, len(test.chatIDs), send.calls)
+		}
+	}
+}
+
+func TestDispatcherPriority(t *testing.T) {
+	dispatcher, clock := newTestDispatcher(DefaultRateLimitConfig)
+	send := &fakeSend{}
+	queueJob(t, dispatcher, PriorityBackground, int64(1), send.call("background 1"))
+	queueJob(t, dispatcher, PriorityBackground, int64(2), send.call("background 2"))
+	queueJob(t, dispatcher, PriorityInteractive, int64(3), send.call("interactive 3"))
+	// Waits for its chat, so it doesn't hold back the others
+	queueJob(t, dispatcher, PriorityInteractive, int64(1), send.call("interactive 1"))
+
+	runReady(dispatcher, clock)
+	expected := []string{"interactive 3", "interactive 1", "background 1", "background 2"}
+	if fmt.Sprint(send.calls) != fmt.Sprint(expected) {
+		t.Errorf("expected the calls %v, got %v", expected, send.calls)
+	}
+}
+
+func TestDispatcherRetryAfter(t *testing.T) {
+	config := DefaultRateLimitConfig
+	config.MaxRetries = 1
+	dispatcher, clock := newTestDispatcher(config)
+	tooManyRequests := fmt.Errorf(`too many requests, {"ok":false,"error_code":429,"parameters":{"retry_after":5}}`)
+	send := &fakeSend{
+		errs: map[string][]error{
+			"retried": {tooManyRequests},
+			"failed":  {tooManyRequests, tooManyRequests},
+		},
+	}
+	retried := queueJob(t, dispatcher, PriorityBackground, int64(1), send.call("retried"))
+	failed := queueJob(t, dispatcher, PriorityBackground, int64(2), send.call("failed"))
+
+	// Telegram asked both chats to wait
+	if wait := runReady(dispatcher, clock); wait != 5*time.Second {
+		t.Errorf("expected to wait as asked, got %v", wait)
+	}
+	clock.Advance(4 * time.Second)
+	runReady(dispatcher, clock)
+	if len(send.calls) != 2 {
+		t.Fatalf("expected no retries before the time, got %v", send.calls)
+	}
+
+	clock.Advance(time.Second)
+	runReady(dispatcher, clock)
+	if err := <-retried.done; err != nil {
+		t.Errorf("expected the retry to succeed, got %v", err)
+	}
+	if err := <-failed.done; RetryAfter(err) == 0 {
+		t.Errorf("expected the rate limit error after the last retry, got %v", err)
+	}
+	stats := dispatcher.Stats()
+	if stats.Sent != 1 || stats.Failed != 1 || stats.RateLimited != 3 || stats.Queued != 0 {
+		t.Errorf("expected 1 sent, 1 failed and 3 rate limited, got %+v", stats)
+	}
+}
+
+func TestDispatcherCancelledRequest(t *testing.T) {
+	config := DefaultRateLimitConfig
+	config.ChatBurst = 1
+	dispatcher, clock := newTestDispatcher(config)
+	send := &fakeSend{}
+	queueJob(t, dispatcher, PriorityBackground, int64(1), send.call("first"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := newJob(ctx, PriorityBackground, "sendMessage", int64(1), send.call("cancelled"))
+	if err := dispatcher.enqueue(cancelled, false); err != nil {
+		t.Fatal(err)
+	}
+	runReady(dispatcher, clock)
+
+	// Dropped while waiting for its chat
+	cancel()
+	clock.Advance(time.Minute)
+	runReady(dispatcher, clock)
+	if err := <-cancelled.done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be cancelled, got %v", err)
+	}
+	if len(send.calls) != 1 || dispatcher.Stats().Queued != 0 {
+		t.Errorf("expected only the first request to be sent, got %v", send.calls)
+	}
+
+	// The caller doesn't wait for the dispatcher to notice
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := dispatcher.do(ctx, PriorityBackground, "sendMessage", int64(2), send.call("second")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be cancelled, got %v", err)
+	}
+}
+
+func TestDispatcherStop(t *testing.T) {
+	config := DefaultRateLimitConfig
+	config.ChatBurst = 0
+	dispatcher := NewDispatcher(nil, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(stopped)
+	}()
+
+	// Never gets a token, so it is still queued when the dispatcher stops
+	result := make(chan error, 1)
+	go func() {
+		result <- dispatcher.do(context.Background(), PriorityBackground, "sendMessage", int64(1), (&fakeSend{}).call("queued"))
+	}()
+	for dispatcher.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-stopped
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the queued request to fail, got %v", err)
+	}
+	if err := dispatcher.do(context.Background(), PriorityBackground, "sendMessage", int64(1), (&fakeSend{}).call("late")); !errors.Is(err, Stopped) {
+		t.Errorf("expected %v, got %v", Stopped, err)
+	}
+}
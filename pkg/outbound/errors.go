@@ -0,0 +1,87 @@
+package outbound
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// The bot library only reports errors as text, containing the response
+	// body for non-200 responses
+	retryAfterRegexp = regexp.MustCompile(`"retry_after"\s*:\s*(\d+)`)
+)
+
+// RetryAfter returns how long Telegram asked to wait before retrying, or 0 if
+// err isn't a 429 Too Many Requests error.
+func RetryAfter(err error) time.Duration {
+	if err == nil {
+		return 0
+	}
+	match := retryAfterRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	seconds, _ := strconv.Atoi(match[1])
+	return time.Second * time.Duration(seconds)
+}
+
+type ErrorKind int
+
+const (
+	ErrorOther ErrorKind = iota
+	// The edit didn't change anything, which can be treated as a success
+	ErrorNotModified
+	// The message was deleted or can't be edited anymore
+	ErrorMessageGone
+	// The bot can't send messages to the chat anymore, e.g. it was blocked
+	// or removed from the group
+	ErrorChatGone
+)
+
+func (kind ErrorKind) String() string {
+	switch kind {
+	case ErrorNotModified:
+		return "not_modified"
+	case ErrorMessageGone:
+		return "message_gone"
+	case ErrorChatGone:
+		return "chat_gone"
+	default:
+		return "other"
+	}
+}
+
+var (
+	errorDescriptions = []struct {
+		description string
+		kind        ErrorKind
+	}{
+		{"message is not modified", ErrorNotModified},
+		{"message to edit not found", ErrorMessageGone},
+		{"message can't be edited", ErrorMessageGone},
+		{"message_id_invalid", ErrorMessageGone},
+		{"bot was blocked by the user", ErrorChatGone},
+		{"user is deactivated", ErrorChatGone},
+		{"bot was kicked", ErrorChatGone},
+		{"bot is not a member", ErrorChatGone},
+		{"group chat was deleted", ErrorChatGone},
+		{"chat not found", ErrorChatGone},
+	}
+)
+
+// ClassifyError finds out what a Telegram error means for the message or chat
+// the request was about.
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return ErrorOther
+	}
+	text := strings.ToLower(err.Error())
+	for _, d := range errorDescriptions {
+		if strings.Contains(text, d.description) {
+			return d.kind
+		}
+	}
+	return ErrorOther
+}
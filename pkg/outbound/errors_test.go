@@ -0,0 +1,52 @@
+package outbound
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorKind
+	}{
+		{nil, ErrorOther},
+		{fmt.Errorf("error response from telegram for method editMessageText, 400 Bad Request: message is not modified: specified new message content and reply markup are exactly the same"), ErrorNotModified},
+		{fmt.Errorf("bad request, Bad Request: message to edit not found"), ErrorMessageGone},
+		{fmt.Errorf("bad request, Bad Request: message can't be edited"), ErrorMessageGone},
+		{fmt.Errorf("bad request, Bad Request: MESSAGE_ID_INVALID"), ErrorMessageGone},
+		{fmt.Errorf("forbidden, Forbidden: bot was blocked by the user"), ErrorChatGone},
+		{fmt.Errorf("forbidden, Forbidden: user is deactivated"), ErrorChatGone},
+		{fmt.Errorf("forbidden, Forbidden: bot was kicked from the supergroup chat"), ErrorChatGone},
+		{fmt.Errorf("forbidden, Forbidden: bot is not a member of the channel chat"), ErrorChatGone},
+		{fmt.Errorf("forbidden, Forbidden: the group chat was deleted"), ErrorChatGone},
+		{fmt.Errorf("bad request, Bad Request: chat not found"), ErrorChatGone},
+		// Wrapped errors are classified by their text
+		{fmt.Errorf("sending update: %w", fmt.Errorf("Forbidden: bot was blocked by the user")), ErrorChatGone},
+		{fmt.Errorf(`too many requests, {"ok":false,"error_code":429,"parameters":{"retry_after":5}}`), ErrorOther},
+		{fmt.Errorf("context deadline exceeded"), ErrorOther},
+	}
+	for _, test := range tests {
+		if kind := ClassifyError(test.err); kind != test.expected {
+			t.Errorf("ClassifyError(%v): expected %v, got %v", test.err, test.expected, kind)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected time.Duration
+	}{
+		{nil, 0},
+		{fmt.Errorf("bad request, Bad Request: chat not found"), 0},
+		{fmt.Errorf(`too many requests, {"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`), 5 * time.Second},
+		{fmt.Errorf(`too many requests, {"retry_after": 31}`), 31 * time.Second},
+	}
+	for _, test := range tests {
+		if retryAfter := RetryAfter(test.err); retryAfter != test.expected {
+			t.Errorf("RetryAfter(%v): expected %v, got %v", test.err, test.expected, retryAfter)
+		}
+	}
+}
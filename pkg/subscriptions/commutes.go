@@ -0,0 +1,257 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/outbound"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+const (
+	noCommutesMessage = "You have no commutes. A commute posts a tracked message for a train on the chosen days of the week, so you don't have to subscribe every day."
+	addCommuteButton  = "Add commute"
+)
+
+// Commute is a recurring subscription. On every day in Weekdays, once the
+// current time is inside the window, a new tracked message is posted for that
+// day's run of the train.
+type Commute struct {
+	gorm.Model
+	ChatId      int64
+	TrainNumber string
+	GroupIndex  int
+	Description string
+	// Bit i is set if the commute is active on time.Weekday(i)
+	Weekdays uint8
+	// Minutes since midnight, in utils.Location
+	WindowStart int
+	WindowEnd   int
+	Paused      bool
+	// The last day a message was posted, as yyyy-mm-dd
+	LastSpawned string
+}
+
+func (commute *Commute) IsDue(now time.Time) bool {
+	now = now.In(utils.Location)
+	minute := now.Hour()*60 + now.Minute()
+	return !commute.Paused &&
+		commute.Weekdays&(1<<now.Weekday()) != 0 &&
+		minute >= commute.WindowStart && minute < commute.WindowEnd &&
+		commute.LastSpawned != now.Format("2006-01-02")
+}
+
+func (sub *Subscriptions) InsertCommute(commute Commute) error {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	if err := sub.store.InsertCommute(&commute); err != nil {
+		return err
+	}
+	sub.commutes[commute.ID] = commute
+	return nil
+}
+
+func (sub *Subscriptions) GetChatCommutes(chatId int64) []Commute {
+	sub.mutex.RLock()
+	defer sub.mutex.RUnlock()
+	result := make([]Commute, 0)
+	for _, commute := range sub.commutes {
+		if commute.ChatId == chatId {
+			result = append(result, commute)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (sub *Subscriptions) ToggleCommutePaused(chatId int64, id uint) error {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	commute, ok := sub.commutes[id]
+	if !ok || commute.ChatId != chatId {
+		return fmt.Errorf("commute %d not found in chat %d", id, chatId)
+	}
+	commute.Paused = !commute.Paused
+	if err := sub.store.UpdateCommute(&commute, "paused"); err != nil {
+		return err
+	}
+	sub.commutes[id] = commute
+	return nil
+}
+
+func (sub *Subscriptions) DeleteCommute(chatId int64, id uint) error {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	commute, ok := sub.commutes[id]
+	if !ok || commute.ChatId != chatId {
+		return fmt.Errorf("commute %d not found in chat %d", id, chatId)
+	}
+	if err := sub.store.DeleteCommute(&commute); err != nil {
+		return err
+	}
+	delete(sub.commutes, id)
+	return nil
+}
+
+// spawnCommutes posts and subscribes to a new tracked message for every
+// commute that is due.
+func (sub *Subscriptions) spawnCommutes(ctx context.Context, polling PollingConfig) {
+	now := time.Now().In(utils.Location)
+	today := now.Format("2006-01-02")
+
+	sub.mutex.RLock()
+	due := make([]Commute, 0)
+	for _, commute := range sub.commutes {
+		if commute.IsDue(now) {
+			due = append(due, commute)
+		}
+	}
+	sub.mutex.RUnlock()
+
+	for _, commute := range due {
+		ctx := logging.With(ctx, logging.ChatIdKey, commute.ChatId, logging.TrainNumberKey, commute.TrainNumber, "commute_id", commute.ID)
+		logger := logging.FromContext(ctx)
+		// Another instance sharing the database may spawn it at the same time
+		spawned := commute
+		claimed, err := sub.store.ClaimCommute(&spawned, today)
+		if err != nil {
+			logger.Error("Claiming commute", logging.Err(err))
+			continue
+		}
+		spawned.LastSpawned = today
+		if !claimed {
+			logger.Debug("Commute already spawned by another instance")
+			sub.setCommute(spawned)
+			continue
+		}
+		// Undoes the claim, to try again on the next tick
+		release := func() {
+			if err := sub.store.UpdateCommute(&commute, "last_spawned"); err != nil {
+				logger.Error("Releasing commute", logging.Err(err))
+			}
+		}
+
+		date := sub.commuteRunDate(ctx, &commute, now)
+		logger.Debug("Spawning commute", "date", date.Format("2006-01-02"))
+		resp, ok := handlers.HandleTrainNumberCommand(ctx, sub.source, commute.TrainNumber, date, commute.GroupIndex, true, polling.UnsubscribeGracePeriod)
+		if !ok || resp == nil || resp.Message == nil {
+			logger.Debug("Error when spawning commute")
+			release()
+			continue
+		}
+		resp.Message.ChatID = commute.ChatId
+		message, err := sub.sender.SendMessage(ctx, resp.Message)
+		if err != nil {
+			logger.Error("Sending commute message", logging.Err(err))
+			if outbound.ClassifyError(err) == outbound.ErrorChatGone {
+				logger.Info("Can't send messages to chat anymore, removing commute")
+				if err := sub.DeleteCommute(commute.ChatId, commute.ID); err != nil {
+					logger.Error("Removing commute", logging.Err(err))
+				}
+				continue
+			}
+			release()
+			continue
+		}
+		if !resp.ShouldUnsubscribe {
+			err = sub.InsertSubscription(SubData{
+				ChatId:      commute.ChatId,
+				MessageId:   message.ID,
+				TrainNumber: commute.TrainNumber,
+				Date:        date,
+				GroupIndex:  commute.GroupIndex,
+			})
+			if err != nil {
+				logger.Error("Subscribing to commute message", logging.Err(err))
+			}
+		}
+
+		sub.setCommute(spawned)
+	}
+}
+
+// commuteRunDate returns the date of the run of the train that departs from
+// one of its stations inside the window of the commute on the day of now. For
+// night trains boarded after midnight, that's the run that started the day
+// before. If no run departs inside the window, today's run is used.
+func (sub *Subscriptions) commuteRunDate(ctx context.Context, commute *Commute, now time.Time) time.Time {
+	now = now.In(utils.Location)
+	windowStart := time.Date(now.Year(), now.Month(), now.Day(), 0, commute.WindowStart, 0, 0, utils.Location)
+	windowEnd := time.Date(now.Year(), now.Month(), now.Day(), 0, commute.WindowEnd, 0, 0, utils.Location)
+	date, ok := handlers.TrainRunDate(ctx, sub.source, commute.TrainNumber, now, func(departure time.Time) bool {
+		return !departure.Before(windowStart) && departure.Before(windowEnd)
+	})
+	if !ok {
+		// Same convention as utils.ParseDate
+		return time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, utils.Location)
+	}
+	return date
+}
+
+// setCommute updates a commute in memory, unless it was deleted.
+func (sub *Subscriptions) setCommute(commute Commute) {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	if _, ok := sub.commutes[commute.ID]; ok {
+		sub.commutes[commute.ID] = commute
+	}
+}
+
+// GetCommutesResponse renders the list of commutes of a chat, with buttons
+// to manage them.
+func GetCommutesResponse(commutes []Commute) *handlers.HandlerResponse {
+	messageText := strings.Builder{}
+	replyButtons := make([][]models.InlineKeyboardButton, 0, len(commutes)+1)
+	if len(commutes) == 0 {
+		messageText.WriteString(noCommutesMessage)
+	} else {
+		messageText.WriteString("Your commutes:\n\n")
+	}
+	for i, commute := range commutes {
+		messageText.WriteString(fmt.Sprintf("%d. Train %s", i+1, commute.TrainNumber))
+		if len(commute.Description) != 0 {
+			messageText.WriteString(fmt.Sprintf(" (%s)", commute.Description))
+		}
+		messageText.WriteString(fmt.Sprintf(", %s, %s – %s", handlers.FormatWeekdays(commute.Weekdays), handlers.FormatMinuteOfDay(commute.WindowStart), handlers.FormatMinuteOfDay(commute.WindowEnd)))
+		pauseText := fmt.Sprintf("%d: Pause", i+1)
+		if commute.Paused {
+			messageText.WriteString(" (paused)")
+			pauseText = fmt.Sprintf("%d: Resume", i+1)
+		}
+		messageText.WriteString("\n")
+		replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+			{
+				Text:         pauseText,
+				CallbackData: fmt.Sprintf(handlers.CommutePauseCallbackQuery+"\x1b%d", commute.ID),
+			},
+			{
+				Text:         fmt.Sprintf("%d: Delete", i+1),
+				CallbackData: fmt.Sprintf(handlers.CommuteDeleteCallbackQuery+"\x1b%d", commute.ID),
+			},
+		})
+	}
+	replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+		{
+			Text:         addCommuteButton,
+			CallbackData: handlers.CommuteAddCallbackQuery,
+		},
+	})
+	return &handlers.HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text: messageText.String(),
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: replyButtons,
+			},
+		},
+	}
+}
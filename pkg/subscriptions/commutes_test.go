@@ -0,0 +1,72 @@
+package subscriptions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+)
+
+// nightTrainSource has a train that leaves Timișoara Nord at 22:30 on the
+// requested date and departs from Arad after midnight.
+type nightTrainSource struct {
+	api.TrainDataSource
+}
+
+func (nightTrainSource) GetTrain(_ context.Context, trainNumber string, date time.Time) (*api.TrainResponse, error) {
+	date = date.In(utils.Location)
+	at := func(days int, hour int, minute int) *api.TrainArrDep {
+		return &api.TrainArrDep{
+			ScheduleTime: time.Date(date.Year(), date.Month(), date.Day()+days, hour, minute, 0, 0, utils.Location),
+		}
+	}
+	return &api.TrainResponse{
+		Rank:   "IR",
+		Number: trainNumber,
+		Groups: []api.TrainGroup{
+			{
+				Stations: []api.TrainStation{
+					{Name: "Timișoara Nord", Departure: at(0, 22, 30)},
+					{Name: "Arad", Arrival: at(1, 0, 5), Departure: at(1, 0, 15)},
+					{Name: "Deva", Arrival: at(1, 2, 40)},
+				},
+			},
+		},
+	}, nil
+}
+
+func TestCommuteRunDate(t *testing.T) {
+	sub, err := LoadSubscriptions(newTestStore(t), nil, nightTrainSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int) time.Time {
+		return time.Date(2024, time.June, d, 12, 0, 0, 0, utils.Location)
+	}
+	tests := []struct {
+		name        string
+		now         time.Time
+		windowStart int
+		windowEnd   int
+		expected    time.Time
+	}{
+		{"boarded at the origin", time.Date(2024, time.June, 10, 22, 0, 0, 0, utils.Location), 22 * 60, 23 * 60, day(10)},
+		// The run boarded after midnight started the day before
+		{"boarded after midnight", time.Date(2024, time.June, 11, 0, 0, 0, 0, utils.Location), 0, 60, day(10)},
+		{"no departure in the window", time.Date(2024, time.June, 11, 5, 0, 0, 0, utils.Location), 5 * 60, 6 * 60, day(11)},
+		// The window is checked on the day of now, not of the run
+		{"window ends before the departure", time.Date(2024, time.June, 11, 0, 0, 0, 0, utils.Location), 0, 15, day(11)},
+	}
+	for _, test := range tests {
+		commute := Commute{
+			TrainNumber: "16000",
+			WindowStart: test.windowStart,
+			WindowEnd:   test.windowEnd,
+		}
+		if date := sub.commuteRunDate(context.Background(), &commute, test.now); !date.Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, date)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package subscriptions
+
+import (
+	"context"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrainLease gives an instance of the bot the exclusive right to check a
+// train run until ExpiresAt, so that instances sharing a database don't edit
+// the same messages or send the same notifications. The owner renews the
+// lease whenever it checks the train; if it stops, another instance takes
+// over once the lease expires.
+type TrainLease struct {
+	TrainNumber string `gorm:"primaryKey"`
+	Day         string `gorm:"primaryKey"`
+	Owner       string
+	ExpiresAt   time.Time
+}
+
+// AcquireLease takes or renews the lease of a train run for owner until the
+// given time. If another owner holds the lease, it returns false and when
+// that lease expires.
+func (store *SubscriptionStore) AcquireLease(key trainKey, owner string, now time.Time, until time.Time) (bool, time.Time, error) {
+	// Times are compared as text by SQLite, so they must all be in UTC
+	lease := TrainLease{
+		TrainNumber: key.trainNumber,
+		Day:         key.day,
+		Owner:       owner,
+		ExpiresAt:   until.UTC(),
+	}
+	result := store.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "train_number"}, {Name: "day"}},
+		DoUpdates: clause.AssignmentColumns([]string{"owner", "expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			gorm.Expr("train_leases.owner = ? OR train_leases.expires_at < ?", owner, now.UTC()),
+		}},
+	}).Create(&lease)
+	if result.Error != nil {
+		return false, time.Time{}, result.Error
+	}
+	if result.RowsAffected != 0 {
+		return true, until, nil
+	}
+	err := store.db.Limit(1).Find(&lease, "train_number = ? AND day = ?", key.trainNumber, key.day).Error
+	return false, lease.ExpiresAt, err
+}
+
+// ReleaseLeases gives up all leases of owner, so that other instances don't
+// have to wait for them to expire.
+func (store *SubscriptionStore) ReleaseLeases(owner string) error {
+	return store.db.Delete(&TrainLease{}, "owner = ?", owner).Error
+}
+
+// DeleteExpiredLeases forgets the leases that expired before the given time.
+func (store *SubscriptionStore) DeleteExpiredLeases(before time.Time) error {
+	return store.db.Delete(&TrainLease{}, "expires_at < ?", before.UTC()).Error
+}
+
+// acquireLeases returns the keys this instance may check now, and when to
+// try again for the others.
+func (sub *Subscriptions) acquireLeases(ctx context.Context, keys []trainKey, polling PollingConfig) ([]trainKey, map[trainKey]time.Time) {
+	now := time.Now()
+	leased := make([]trainKey, 0, len(keys))
+	retries := map[trainKey]time.Time{}
+	for _, key := range keys {
+		// Long enough to finish the check, it is renewed afterwards
+		ok, expires, err := sub.store.AcquireLease(key, polling.InstanceId, now, now.Add(polling.LeaseMargin))
+		switch {
+		case err != nil:
+			logging.FromContext(ctx).Error("Acquiring train lease", logging.TrainNumberKey, key.trainNumber, "date", key.day, logging.Err(err))
+			retries[key] = now.Add(polling.ErrorInterval)
+		case !ok:
+			if earliest := now.Add(polling.MinInterval); expires.Before(earliest) {
+				expires = earliest
+			}
+			retries[key] = expires
+		default:
+			leased = append(leased, key)
+		}
+	}
+	return leased, retries
+}
+
+// renewLease keeps the lease of a train run until its next check is done. It
+// returns false if the lease couldn't be renewed, e.g. because it expired
+// during the check and another instance took it over.
+func (sub *Subscriptions) renewLease(ctx context.Context, key trainKey, next time.Time, polling PollingConfig) bool {
+	ok, _, err := sub.store.AcquireLease(key, polling.InstanceId, time.Now(), next.Add(polling.LeaseMargin))
+	switch {
+	case err != nil:
+		logging.FromContext(ctx).Error("Renewing train lease", logging.TrainNumberKey, key.trainNumber, "date", key.day, logging.Err(err))
+	case !ok:
+		logging.FromContext(ctx).Warn("Train lease was taken over by another instance", logging.TrainNumberKey, key.trainNumber, "date", key.day)
+	}
+	return err == nil && ok
+}
@@ -0,0 +1,215 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	noSubscriptionsMessage = "You are not subscribed to any train. Use the Subscribe button below a train's information to get updates."
+	unsubscribeAllButton   = "Unsubscribe from all"
+	trackedMessageText     = "tracked message"
+	showTrackedButton      = "%d: Show message"
+	trackedMessageReply    = "This is the message of train %s."
+
+	subscriptionsPerPage = 10
+
+	// The list is still shown without routes if the trains take longer
+	listLookupTimeout = 3 * time.Second
+	listLookupWorkers = 4
+)
+
+// GetChatSubscriptions returns the subscriptions of a chat, ordered by date.
+// Subscriptions of messages sent via inline mode aren't included.
+func (sub *Subscriptions) GetChatSubscriptions(chatId int64) []SubData {
+	sub.mutex.RLock()
+	defer sub.mutex.RUnlock()
+	result := make([]SubData, 0)
+	for ref, data := range sub.data {
+		if !ref.IsInline() && ref.ChatId == chatId {
+			result = append(result, data)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Date.Equal(result[j].Date) {
+			return result[i].Date.Before(result[j].Date)
+		}
+		return result[i].MessageId < result[j].MessageId
+	})
+	return result
+}
+
+// lookupTrains gets the train runs of subs concurrently, leaving out the ones
+// that couldn't be found within listLookupTimeout.
+func (sub *Subscriptions) lookupTrains(ctx context.Context, subs []SubData) map[trainKey]*api.TrainResponse {
+	ctx, cancel := context.WithTimeout(ctx, listLookupTimeout)
+	defer cancel()
+
+	dates := map[trainKey]time.Time{}
+	for i := range subs {
+		dates[subs[i].trainKey()] = subs[i].Date
+	}
+	keys := make(chan trainKey, len(dates))
+	for key := range dates {
+		keys <- key
+	}
+	close(keys)
+
+	mutex := sync.Mutex{}
+	trains := make(map[trainKey]*api.TrainResponse, len(dates))
+	wg := sync.WaitGroup{}
+	for i := 0; i < listLookupWorkers && i < len(dates); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				trainData, err := sub.source.GetTrain(ctx, key.trainNumber, dates[key])
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				trains[key] = trainData
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return trains
+}
+
+// GetSubscriptionsListResponse renders one page of the list of subscriptions
+// of a chat, with buttons to unsubscribe.
+func (sub *Subscriptions) GetSubscriptionsListResponse(ctx context.Context, subs []SubData, page int) *handlers.HandlerResponse {
+	if len(subs) == 0 {
+		return &handlers.HandlerResponse{
+			Message: &bot.SendMessageParams{
+				Text: noSubscriptionsMessage,
+			},
+		}
+	}
+
+	pageCount := (len(subs) + subscriptionsPerPage - 1) / subscriptionsPerPage
+	if page >= pageCount {
+		page = pageCount - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+	first := page * subscriptionsPerPage
+	last := first + subscriptionsPerPage
+	if last > len(subs) {
+		last = len(subs)
+	}
+
+	messageText := strings.Builder{}
+	entities := make([]models.MessageEntity, 0, last-first)
+	replyButtons := make([][]models.InlineKeyboardButton, 0, last-first+2)
+	if pageCount > 1 {
+		messageText.WriteString(fmt.Sprintf("Your subscriptions (page %d of %d):\n\n", page+1, pageCount))
+	} else {
+		messageText.WriteString("Your subscriptions:\n\n")
+	}
+	trains := sub.lookupTrains(ctx, subs[first:last])
+	for i := first; i < last; i++ {
+		data := &subs[i]
+		trainName := data.TrainNumber
+		route := ""
+		// The route isn't stored, so it is only shown if the train can be found
+		if trainData, ok := trains[data.trainKey()]; ok {
+			trainName = fmt.Sprintf("%s %s", trainData.Rank, trainData.Number)
+			if data.GroupIndex >= 0 && data.GroupIndex < len(trainData.Groups) {
+				groupRoute := trainData.Groups[data.GroupIndex].Route
+				route = fmt.Sprintf(" (%s ➔ %s)", groupRoute.From, groupRoute.To)
+			}
+		}
+		messageText.WriteString(fmt.Sprintf("%d. Train %s%s, %s", i+1, trainName, route, data.Date.In(utils.Location).Format("02.01.2006")))
+		row := []models.InlineKeyboardButton{
+			{
+				Text:         fmt.Sprintf("%d: Unsubscribe", i+1),
+				CallbackData: fmt.Sprintf(handlers.SubscriptionsUnsubscribeCallbackQuery+"\x1b%d\x1b%d", data.MessageId, page),
+			},
+		}
+		if link := handlers.GetMessageLink(data.ChatId, data.MessageId); len(link) != 0 {
+			messageText.WriteString(", ")
+			entities = append(entities, models.MessageEntity{
+				Type:   models.MessageEntityTypeTextLink,
+				Offset: utils.UTF16Len(messageText.String()),
+				Length: utils.UTF16Len(trackedMessageText),
+				URL:    link,
+			})
+			messageText.WriteString(trackedMessageText)
+		} else {
+			// Private chats have no message links, so the message is found by
+			// replying to it instead
+			row = append(row, models.InlineKeyboardButton{
+				Text:         fmt.Sprintf(showTrackedButton, i+1),
+				CallbackData: fmt.Sprintf(handlers.SubscriptionsShowCallbackQuery+"\x1b%d", data.MessageId),
+			})
+		}
+		messageText.WriteString("\n")
+		replyButtons = append(replyButtons, row)
+	}
+	replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+		{
+			Text:         unsubscribeAllButton,
+			CallbackData: handlers.SubscriptionsUnsubscribeAllCallbackQuery,
+		},
+	})
+
+	pageButtons := make([]models.InlineKeyboardButton, 0, 2)
+	if page > 0 {
+		pageButtons = append(pageButtons, models.InlineKeyboardButton{
+			Text:         handlers.PreviousPageButton,
+			CallbackData: fmt.Sprintf(handlers.SubscriptionsPageCallbackQuery+"\x1b%d", page-1),
+		})
+	}
+	if page+1 < pageCount {
+		pageButtons = append(pageButtons, models.InlineKeyboardButton{
+			Text:         handlers.NextPageButton,
+			CallbackData: fmt.Sprintf(handlers.SubscriptionsPageCallbackQuery+"\x1b%d", page+1),
+		})
+	}
+	if len(pageButtons) > 0 {
+		replyButtons = append(replyButtons, pageButtons)
+	}
+	return &handlers.HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text:                  messageText.String(),
+			Entities:              entities,
+			DisableWebPagePreview: true,
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: replyButtons,
+			},
+		},
+	}
+}
+
+// HandleShowCallback replies to the tracked message of a subscription, for
+// chats that have no message links.
+func (sub *Subscriptions) HandleShowCallback(ref MessageRef) *handlers.HandlerResponse {
+	data, ok := sub.GetSubscription(ref)
+	if !ok {
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "You are no longer subscribed to this train.",
+				ShowAlert: true,
+			},
+		}
+	}
+	return &handlers.HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text:             fmt.Sprintf(trackedMessageReply, data.TrainNumber),
+			ReplyToMessageID: data.MessageId,
+		},
+	}
+}
@@ -0,0 +1,109 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"github.com/go-telegram/bot/models"
+)
+
+func newTestListSubscriptions(t *testing.T, chatId int64, count int) (*Subscriptions, []SubData) {
+	t.Helper()
+	// No train can be found, so the routes are left out
+	sub, err := LoadSubscriptions(newTestStore(t), nil, api.NewFixtureSource(fstest.MapFS{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := sub.InsertSubscription(newTestSubData(chatId, 100+i, fmt.Sprintf("%d", 1000+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sub, sub.GetChatSubscriptions(chatId)
+}
+
+func listKeyboard(t *testing.T, response *handlers.HandlerResponse) [][]models.InlineKeyboardButton {
+	t.Helper()
+	if response == nil || response.Message == nil {
+		t.Fatalf("expected a message, got %+v", response)
+	}
+	markup, ok := response.Message.ReplyMarkup.(models.InlineKeyboardMarkup)
+	if !ok {
+		t.Fatalf("expected an inline keyboard, got %T", response.Message.ReplyMarkup)
+	}
+	return markup.InlineKeyboard
+}
+
+func TestGetSubscriptionsListResponsePages(t *testing.T) {
+	const supergroupId = -1001234
+	sub, subs := newTestListSubscriptions(t, supergroupId, subscriptionsPerPage+3)
+	tests := []struct {
+		page          int
+		expectedFirst int
+		expectedCount int
+		expectedPages []string
+	}{
+		{0, 1, subscriptionsPerPage, []string{handlers.NextPageButton}},
+		{1, subscriptionsPerPage + 1, 3, []string{handlers.PreviousPageButton}},
+		// Out of range pages show the closest one
+		{5, subscriptionsPerPage + 1, 3, []string{handlers.PreviousPageButton}},
+		{-1, 1, subscriptionsPerPage, []string{handlers.NextPageButton}},
+	}
+	for _, test := range tests {
+		response := sub.GetSubscriptionsListResponse(context.Background(), subs, test.page)
+		keyboard := listKeyboard(t, response)
+		// A row per subscription, unsubscribing from all and the pages
+		if len(keyboard) != test.expectedCount+2 {
+			t.Fatalf("page %d: expected %d rows, got %d", test.page, test.expectedCount+2, len(keyboard))
+		}
+		if text := keyboard[0][0].Text; text != fmt.Sprintf("%d: Unsubscribe", test.expectedFirst) {
+			t.Errorf("page %d: expected the first subscription to be %d, got %q", test.page, test.expectedFirst, text)
+		}
+		if lines := strings.Count(response.Message.Text, "tracked message"); lines != test.expectedCount {
+			t.Errorf("page %d: expected %d subscriptions in the text, got %d", test.page, test.expectedCount, lines)
+		}
+		if len(response.Message.Entities) != test.expectedCount {
+			t.Errorf("page %d: expected %d links, got %d", test.page, test.expectedCount, len(response.Message.Entities))
+		}
+		pageRow := keyboard[len(keyboard)-1]
+		if len(pageRow) != len(test.expectedPages) {
+			t.Fatalf("page %d: expected the page buttons %v, got %+v", test.page, test.expectedPages, pageRow)
+		}
+		for i, text := range test.expectedPages {
+			if pageRow[i].Text != text {
+				t.Errorf("page %d: expected the page button %q, got %q", test.page, text, pageRow[i].Text)
+			}
+		}
+	}
+}
+
+func TestGetSubscriptionsListResponsePrivateChat(t *testing.T) {
+	sub, subs := newTestListSubscriptions(t, 42, 2)
+	response := sub.GetSubscriptionsListResponse(context.Background(), subs, 0)
+	keyboard := listKeyboard(t, response)
+	if len(response.Message.Entities) != 0 || strings.Contains(response.Message.Text, "tracked message") {
+		t.Errorf("expected no message links in a private chat, got %q", response.Message.Text)
+	}
+	// A single page, so there are no page buttons
+	if len(keyboard) != 3 {
+		t.Fatalf("expected 3 rows, got %+v", keyboard)
+	}
+	row := keyboard[1]
+	expectedData := fmt.Sprintf(handlers.SubscriptionsShowCallbackQuery+"\x1b%d", subs[1].MessageId)
+	if len(row) != 2 || row[1].CallbackData != expectedData {
+		t.Fatalf("expected a button with callback %q, got %+v", expectedData, row)
+	}
+
+	show := sub.HandleShowCallback(subs[1].Ref())
+	if show.Message == nil || show.Message.ReplyToMessageID != subs[1].MessageId {
+		t.Errorf("expected a reply to message %d, got %+v", subs[1].MessageId, show.Message)
+	}
+	if missing := sub.HandleShowCallback(MessageRef{ChatId: 42, MessageId: 1}); missing.Message != nil || missing.CallbackAnswer == nil {
+		t.Errorf("expected an alert for an unknown subscription, got %+v", missing)
+	}
+}
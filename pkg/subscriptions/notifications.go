@@ -0,0 +1,165 @@
+package subscriptions
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	NotificationRuleDelay          = "delay"
+	NotificationRuleCancellation   = "cancel"
+	NotificationRulePlatformChange = "platform"
+	NotificationRuleDeparture      = "departure"
+)
+
+var (
+	// Pressing the delay button cycles through these thresholds, 0 meaning disabled
+	delayThresholds = []int{0, 5, 10, 15, 30, 60}
+)
+
+// NotificationRules are the events for which a new message is sent,
+// in addition to editing the tracked message.
+type NotificationRules struct {
+	// Notify when the delay reaches this many minutes; 0 disables the rule
+	DelayThreshold int
+	Cancellation   bool
+	PlatformChange bool
+	Departure      bool
+}
+
+// NotificationState remembers what was already sent, so that the same event
+// isn't notified on every check.
+type NotificationState struct {
+	DelayNotified        bool
+	CancellationNotified bool
+	LastPlatform         string
+	DepartureNotified    bool
+}
+
+func (rules *NotificationRules) Toggle(rule string) {
+	switch rule {
+	case NotificationRuleDelay:
+		next := delayThresholds[0]
+		for i, threshold := range delayThresholds {
+			if threshold == rules.DelayThreshold && i+1 < len(delayThresholds) {
+				next = delayThresholds[i+1]
+				break
+			}
+		}
+		rules.DelayThreshold = next
+	case NotificationRuleCancellation:
+		rules.Cancellation = !rules.Cancellation
+	case NotificationRulePlatformChange:
+		rules.PlatformChange = !rules.PlatformChange
+	case NotificationRuleDeparture:
+		rules.Departure = !rules.Departure
+	}
+}
+
+func (rules *NotificationRules) Any() bool {
+	return rules.DelayThreshold > 0 || rules.Cancellation || rules.PlatformChange || rules.Departure
+}
+
+// evaluateNotifications checks the rules of data against the latest train data,
+// returning the notifications to send and the updated state.
+func evaluateNotifications(data *SubData, trainData *api.TrainResponse) ([]string, NotificationState) {
+	state := data.NotifyState
+	if trainData == nil || data.GroupIndex < 0 || data.GroupIndex >= len(trainData.Groups) {
+		return nil, state
+	}
+	group := &trainData.Groups[data.GroupIndex]
+	if len(group.Stations) == 0 {
+		return nil, state
+	}
+	trainName := fmt.Sprintf("%s %s", trainData.Rank, trainData.Number)
+	myStation := &group.Stations[0]
+	if fromIdx := handlers.FindStationIndex(group, data.FromStation); fromIdx != -1 {
+		myStation = &group.Stations[fromIdx]
+	}
+	notifications := make([]string, 0)
+
+	if group.Status != nil {
+		if data.Notify.DelayThreshold > 0 && group.Status.Delay >= data.Notify.DelayThreshold {
+			if !state.DelayNotified {
+				notifications = append(notifications, fmt.Sprintf("⏱ Train %s is now %d min late (%s).", trainName, group.Status.Delay, group.Status.Station))
+			}
+			state.DelayNotified = true
+		} else {
+			state.DelayNotified = false
+		}
+	}
+
+	if data.Notify.Cancellation && !state.CancellationNotified {
+		for _, station := range group.Stations {
+			if isCancelled(station.Arrival) || isCancelled(station.Departure) {
+				notifications = append(notifications, fmt.Sprintf("❌ Train %s is cancelled at %s.", trainName, station.Name))
+				state.CancellationNotified = true
+				break
+			}
+		}
+	}
+
+	if myStation.Platform != nil && len(*myStation.Platform) != 0 {
+		if data.Notify.PlatformChange && len(state.LastPlatform) != 0 && state.LastPlatform != *myStation.Platform {
+			notifications = append(notifications, fmt.Sprintf("🚉 Train %s changed platform at %s: %s ➔ %s.", trainName, myStation.Name, state.LastPlatform, *myStation.Platform))
+		}
+		state.LastPlatform = *myStation.Platform
+	}
+
+	if data.Notify.Departure && !state.DepartureNotified && myStation.Departure != nil && myStation.Departure.Status != nil && myStation.Departure.Status.Real {
+		departure := myStation.Departure.ScheduleTime.Add(time.Minute * time.Duration(myStation.Departure.Status.Delay))
+		if time.Now().After(departure) {
+			notifications = append(notifications, fmt.Sprintf("🚆 Train %s departed from %s at %s.", trainName, myStation.Name, departure.In(utils.Location).Format("15:04")))
+			state.DepartureNotified = true
+		}
+	}
+
+	return notifications, state
+}
+
+func isCancelled(arrDep *api.TrainArrDep) bool {
+	return arrDep != nil && arrDep.Status != nil && arrDep.Status.Cancelled
+}
+
+// GetNotificationSettingsResponse renders the settings message for the
+// notification rules of a subscription.
+func GetNotificationSettingsResponse(data *SubData) *handlers.HandlerResponse {
+	onOff := func(value bool) string {
+		if value {
+			return "on"
+		}
+		return "off"
+	}
+	delay := "off"
+	if data.Notify.DelayThreshold > 0 {
+		delay = fmt.Sprintf("≥ %d min", data.Notify.DelayThreshold)
+	}
+	button := func(text string, rule string) []models.InlineKeyboardButton {
+		return []models.InlineKeyboardButton{
+			{
+				Text:         text,
+				CallbackData: handlers.TrainInfoNotificationSetCallbackQuery + "\x1b" + strconv.Itoa(data.MessageId) + "\x1b" + rule,
+			},
+		}
+	}
+	return &handlers.HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text: fmt.Sprintf("Notifications for train %s on %s.\n\nA new message will be sent when one of the enabled events happens. Press a button to change it.", data.TrainNumber, data.Date.In(utils.Location).Format("02.01.2006")),
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: [][]models.InlineKeyboardButton{
+					button(fmt.Sprintf("Delay: %s", delay), NotificationRuleDelay),
+					button(fmt.Sprintf("Cancellation: %s", onOff(data.Notify.Cancellation)), NotificationRuleCancellation),
+					button(fmt.Sprintf("Platform change: %s", onOff(data.Notify.PlatformChange)), NotificationRulePlatformChange),
+					button(fmt.Sprintf("Departure: %s", onOff(data.Notify.Departure)), NotificationRuleDeparture),
+				},
+			},
+		},
+	}
+}
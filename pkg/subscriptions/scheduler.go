@@ -0,0 +1,217 @@
+package subscriptions
+
+import (
+	"container/heap"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+)
+
+// PollingConfig bounds how often a train is checked. Trains are checked more
+// often the closer their next arrival or departure is.
+type PollingConfig struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Upper bound while the train is between its first and last station, so
+	// that delays are updated even between stops far apart
+	MaxRunningInterval time.Duration
+	// Used when the train couldn't be checked
+	ErrorInterval time.Duration
+	// How many trains are checked at the same time
+	WorkerCount int
+	// Identifies this instance in train leases. Instances sharing a database
+	// must use different ones.
+	InstanceId string
+	// How long a lease outlives the next check of the train, see TrainLease
+	LeaseMargin time.Duration
+	// How long after the scheduled arrival at the last station a tracked
+	// message keeps being updated
+	UnsubscribeGracePeriod time.Duration
+}
+
+var DefaultPollingConfig = PollingConfig{
+	MinInterval:            20 * time.Second,
+	MaxInterval:            10 * time.Minute,
+	MaxRunningInterval:     2 * time.Minute,
+	ErrorInterval:          2 * time.Minute,
+	WorkerCount:            8,
+	LeaseMargin:            time.Minute,
+	UnsubscribeGracePeriod: handlers.DefaultUnsubscribeGracePeriod,
+}
+
+// WithIntervals returns config with the given bounds of the interval between
+// checks, keeping the other bounds within them.
+func (config PollingConfig) WithIntervals(minInterval time.Duration, maxInterval time.Duration) PollingConfig {
+	config.MinInterval = minInterval
+	config.MaxInterval = maxInterval
+	if config.MaxRunningInterval > config.MaxInterval {
+		config.MaxRunningInterval = config.MaxInterval
+	}
+	if config.MaxRunningInterval < config.MinInterval {
+		config.MaxRunningInterval = config.MinInterval
+	}
+	return config
+}
+
+// nextCheckInterval returns how long to wait before checking the train again,
+// based on the groups the subscribers follow.
+func (config *PollingConfig) nextCheckInterval(trainData *api.TrainResponse, groupIndexes []int, now time.Time) time.Duration {
+	if trainData == nil {
+		return config.clamp(config.ErrorInterval)
+	}
+	interval := config.MaxInterval
+	for _, groupIndex := range groupIndexes {
+		if groupIndex < 0 || groupIndex >= len(trainData.Groups) {
+			continue
+		}
+		if groupInterval := config.groupInterval(&trainData.Groups[groupIndex], now); groupInterval < interval {
+			interval = groupInterval
+		}
+	}
+	return config.clamp(interval)
+}
+
+func (config *PollingConfig) groupInterval(group *api.TrainGroup, now time.Time) time.Duration {
+	realTime := func(arrDep *api.TrainArrDep) time.Time {
+		if arrDep.Status != nil {
+			return arrDep.ScheduleTime.Add(time.Minute * time.Duration(arrDep.Status.Delay))
+		}
+		return arrDep.ScheduleTime
+	}
+
+	departed := false
+	for i := range group.Stations {
+		station := &group.Stations[i]
+		for _, arrDep := range []*api.TrainArrDep{station.Arrival, station.Departure} {
+			if arrDep == nil {
+				continue
+			}
+			eventTime := realTime(arrDep)
+			if !eventTime.After(now) {
+				departed = true
+				continue
+			}
+			// A third of the time left, so the next event is seen a few
+			// times before it happens
+			interval := eventTime.Sub(now) / 3
+			if departed && interval > config.MaxRunningInterval {
+				interval = config.MaxRunningInterval
+			}
+			return interval
+		}
+	}
+	// Arrived at the last station
+	return config.MaxInterval
+}
+
+func (config *PollingConfig) clamp(interval time.Duration) time.Duration {
+	if interval < config.MinInterval {
+		return config.MinInterval
+	}
+	if interval > config.MaxInterval {
+		return config.MaxInterval
+	}
+	return interval
+}
+
+type scheduledCheck struct {
+	key   trainKey
+	next  time.Time
+	index int
+}
+
+// checkQueue is a priority queue of checks, ordered by the time they are due.
+type checkQueue []*scheduledCheck
+
+func (queue checkQueue) Len() int {
+	return len(queue)
+}
+
+func (queue checkQueue) Less(i, j int) bool {
+	return queue[i].next.Before(queue[j].next)
+}
+
+func (queue checkQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *checkQueue) Push(x any) {
+	check := x.(*scheduledCheck)
+	check.index = len(*queue)
+	*queue = append(*queue, check)
+}
+
+func (queue *checkQueue) Pop() any {
+	old := *queue
+	n := len(old)
+	check := old[n-1]
+	old[n-1] = nil
+	*queue = old[0 : n-1]
+	return check
+}
+
+// checkSchedule keeps the time of the next check of every train run that has
+// subscribers.
+type checkSchedule struct {
+	queue checkQueue
+	byKey map[trainKey]*scheduledCheck
+}
+
+func newCheckSchedule() *checkSchedule {
+	return &checkSchedule{
+		queue: checkQueue{},
+		byKey: map[trainKey]*scheduledCheck{},
+	}
+}
+
+// sync schedules the new keys at firstCheck and forgets the keys that no
+// longer have subscribers.
+func (schedule *checkSchedule) sync(keys map[trainKey]bool, firstCheck time.Time) {
+	for key, check := range schedule.byKey {
+		if !keys[key] {
+			heap.Remove(&schedule.queue, check.index)
+			delete(schedule.byKey, key)
+		}
+	}
+	for key := range keys {
+		if _, ok := schedule.byKey[key]; !ok {
+			schedule.set(key, firstCheck)
+		}
+	}
+}
+
+func (schedule *checkSchedule) set(key trainKey, next time.Time) {
+	if check, ok := schedule.byKey[key]; ok {
+		check.next = next
+		heap.Fix(&schedule.queue, check.index)
+		return
+	}
+	check := &scheduledCheck{
+		key:  key,
+		next: next,
+	}
+	heap.Push(&schedule.queue, check)
+	schedule.byKey[key] = check
+}
+
+// popDue removes and returns the keys whose checks are due at now.
+func (schedule *checkSchedule) popDue(now time.Time) []trainKey {
+	due := make([]trainKey, 0)
+	for len(schedule.queue) > 0 && !schedule.queue[0].next.After(now) {
+		check := heap.Pop(&schedule.queue).(*scheduledCheck)
+		delete(schedule.byKey, check.key)
+		due = append(due, check.key)
+	}
+	return due
+}
+
+// next returns the time of the earliest check, if any.
+func (schedule *checkSchedule) next() (time.Time, bool) {
+	if len(schedule.queue) == 0 {
+		return time.Time{}, false
+	}
+	return schedule.queue[0].next, true
+}
@@ -0,0 +1,192 @@
+package subscriptions
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+)
+
+// noEvent marks a station without an arrival or a departure in testGroup.
+const noEvent = -1 << 31
+
+// testGroup returns a group with a station for every pair of arrival and
+// departure times, given in minutes from now.
+func testGroup(now time.Time, events ...[2]int) api.TrainGroup {
+	at := func(minutes int) *api.TrainArrDep {
+		if minutes == noEvent {
+			return nil
+		}
+		return &api.TrainArrDep{
+			ScheduleTime: now.Add(time.Minute * time.Duration(minutes)),
+		}
+	}
+	group := api.TrainGroup{}
+	for i, event := range events {
+		group.Stations = append(group.Stations, api.TrainStation{
+			Name:      fmt.Sprintf("Station %d", i),
+			Arrival:   at(event[0]),
+			Departure: at(event[1]),
+		})
+	}
+	return group
+}
+
+func TestNextCheckInterval(t *testing.T) {
+	config := DefaultPollingConfig
+	now := time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+	route := func(departure int, arrival int) api.TrainGroup {
+		return testGroup(now, [2]int{noEvent, departure}, [2]int{arrival, noEvent})
+	}
+	delayed := route(-60, -1)
+	delayed.Stations[1].Arrival.Status = &struct {
+		Delay     int  `json:"delay"`
+		Real      bool `json:"real"`
+		Cancelled bool `json:"cancelled"`
+	}{Delay: 5}
+
+	tests := []struct {
+		name         string
+		groups       []api.TrainGroup
+		groupIndexes []int
+		expected     time.Duration
+	}{
+		{"departs in a few hours", []api.TrainGroup{route(180, 300)}, []int{0}, config.MaxInterval},
+		{"departs in 15 minutes", []api.TrainGroup{route(15, 300)}, []int{0}, 5 * time.Minute},
+		{"departs in 3 minutes", []api.TrainGroup{route(3, 300)}, []int{0}, time.Minute},
+		{"departs now", []api.TrainGroup{testGroup(now, [2]int{noEvent, 0}, [2]int{1, 2}, [2]int{300, noEvent})}, []int{0}, config.MinInterval},
+		// While running, the next station is checked more often even if far
+		{"running between stations far apart", []api.TrainGroup{route(-60, 120)}, []int{0}, config.MaxRunningInterval},
+		{"running, arrives in 3 minutes", []api.TrainGroup{route(-60, 3)}, []int{0}, time.Minute},
+		{"running late", []api.TrainGroup{delayed}, []int{0}, 80 * time.Second},
+		{"arrived", []api.TrainGroup{route(-300, -5)}, []int{0}, config.MaxInterval},
+		// The closest of the followed groups
+		{"several groups", []api.TrainGroup{route(180, 300), route(3, 300)}, []int{0, 1}, time.Minute},
+		{"group not followed", []api.TrainGroup{route(180, 300), route(3, 300)}, []int{0}, config.MaxInterval},
+		{"unknown group", []api.TrainGroup{route(3, 300)}, []int{1, -1}, config.MaxInterval},
+	}
+	for _, test := range tests {
+		trainData := &api.TrainResponse{
+			Number: "1741",
+			Groups: test.groups,
+		}
+		interval := config.nextCheckInterval(trainData, test.groupIndexes, now)
+		if interval != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, interval)
+		}
+		if interval < config.MinInterval || interval > config.MaxInterval {
+			t.Errorf("%s: %v is out of the bounds", test.name, interval)
+		}
+	}
+
+	if interval := config.nextCheckInterval(nil, []int{0}, now); interval != config.ErrorInterval {
+		t.Errorf("expected %v when the train couldn't be checked, got %v", config.ErrorInterval, interval)
+	}
+}
+
+func TestPollingConfigClamp(t *testing.T) {
+	config := PollingConfig{
+		MinInterval: 30 * time.Second,
+		MaxInterval: 5 * time.Minute,
+	}
+	tests := []struct {
+		interval time.Duration
+		expected time.Duration
+	}{
+		{-time.Minute, 30 * time.Second},
+		{0, 30 * time.Second},
+		{time.Minute, time.Minute},
+		{5 * time.Minute, 5 * time.Minute},
+		{time.Hour, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		if interval := config.clamp(test.interval); interval != test.expected {
+			t.Errorf("clamp(%v): expected %v, got %v", test.interval, test.expected, interval)
+		}
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	now := time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+	key := func(trainNumber string) trainKey {
+		return trainKey{trainNumber: trainNumber, day: "2024-06-10"}
+	}
+	schedule := newCheckSchedule()
+	if _, ok := schedule.next(); ok {
+		t.Error("expected an empty schedule")
+	}
+
+	schedule.set(key("3"), now.Add(3*time.Minute))
+	schedule.set(key("1"), now.Add(time.Minute))
+	schedule.set(key("4"), now.Add(4*time.Minute))
+	schedule.set(key("2"), now.Add(5*time.Minute))
+	// Moves an existing check
+	schedule.set(key("2"), now.Add(2*time.Minute))
+	// New keys are checked at firstCheck, and removed ones are forgotten
+	schedule.sync(map[trainKey]bool{key("1"): true, key("2"): true, key("3"): true, key("5"): true}, now.Add(5*time.Minute))
+
+	if next, ok := schedule.next(); !ok || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the next check at %v, got %v", now.Add(time.Minute), next)
+	}
+	if due := schedule.popDue(now); len(due) != 0 {
+		t.Errorf("expected nothing to be due, got %v", due)
+	}
+	tests := []struct {
+		now      time.Time
+		expected []trainKey
+	}{
+		{now.Add(2 * time.Minute), []trainKey{key("1"), key("2")}},
+		{now.Add(4 * time.Minute), []trainKey{key("3")}},
+		{now.Add(10 * time.Minute), []trainKey{key("5")}},
+		{now.Add(20 * time.Minute), []trainKey{}},
+	}
+	for _, test := range tests {
+		if due := schedule.popDue(test.now); fmt.Sprint(due) != fmt.Sprint(test.expected) {
+			t.Errorf("popDue(%v): expected %v, got %v", test.now, test.expected, due)
+		}
+	}
+	if len(schedule.byKey) != 0 || len(schedule.queue) != 0 {
+		t.Errorf("expected the popped checks to be forgotten, got %v", schedule.byKey)
+	}
+}
+
+func TestCheckScheduleOrder(t *testing.T) {
+	now := time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+	schedule := newCheckSchedule()
+	// Added in a scrambled order
+	for _, minutes := range []int{7, 2, 9, 0, 5, 3, 8, 1, 6, 4} {
+		schedule.set(trainKey{trainNumber: fmt.Sprint(minutes)}, now.Add(time.Minute*time.Duration(minutes)))
+	}
+	due := schedule.popDue(now.Add(time.Hour))
+	if len(due) != 10 {
+		t.Fatalf("expected 10 checks, got %v", due)
+	}
+	for i, key := range due {
+		if key.trainNumber != fmt.Sprint(i) {
+			t.Errorf("expected check %d to be train %d, got %s", i, i, key.trainNumber)
+		}
+	}
+}
+
+func TestPollingConfigWithIntervals(t *testing.T) {
+	tests := []struct {
+		minInterval        time.Duration
+		maxInterval        time.Duration
+		expectedMaxRunning time.Duration
+	}{
+		{20 * time.Second, 10 * time.Minute, DefaultPollingConfig.MaxRunningInterval},
+		// The other bounds stay within the configured ones
+		{20 * time.Second, time.Minute, time.Minute},
+		{5 * time.Minute, 10 * time.Minute, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		config := DefaultPollingConfig.WithIntervals(test.minInterval, test.maxInterval)
+		if config.MinInterval != test.minInterval || config.MaxInterval != test.maxInterval || config.MaxRunningInterval != test.expectedMaxRunning {
+			t.Errorf("WithIntervals(%v, %v): expected the bounds %v, %v and %v, got %+v", test.minInterval, test.maxInterval, test.minInterval, test.maxInterval, test.expectedMaxRunning, config)
+		}
+		if config.WorkerCount != DefaultPollingConfig.WorkerCount || config.ErrorInterval != DefaultPollingConfig.ErrorInterval {
+			t.Errorf("WithIntervals(%v, %v): expected the other settings to be kept, got %+v", test.minInterval, test.maxInterval, config)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	chooseFromMessage = "Choose the station where you board train %s on %s."
+	chooseToMessage   = "Choose the station where you get off train %s on %s."
+	stopsSetMessage   = "Your stations for train %s on %s: %s ➔ %s."
+	wholeRouteButton  = "Whole route"
+
+	// Telegram rejects keyboards with more than 100 buttons
+	stopsPerPage = 40
+)
+
+func (data *SubData) Stops() handlers.TrainStops {
+	return handlers.TrainStops{
+		From: data.FromStation,
+		To:   data.ToStation,
+	}
+}
+
+func (sub *Subscriptions) UpdateStops(ref MessageRef, stops handlers.TrainStops) (*SubData, error) {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	data, ok := sub.data[ref]
+	if !ok {
+		return nil, fmt.Errorf("subscription for %s not found", ref)
+	}
+	data.FromStation = stops.From
+	data.ToStation = stops.To
+	if err := sub.store.Update(&data, "from_station", "to_station"); err != nil {
+		return nil, err
+	}
+	sub.data[ref] = data
+	return &data, nil
+}
+
+// GetStopsPickerResponse asks the user for the station where they board the
+// subscribed train.
+func (sub *Subscriptions) GetStopsPickerResponse(ctx context.Context, data *SubData) *handlers.HandlerResponse {
+	group, err := sub.getSubscribedGroup(ctx, data)
+	if err != nil {
+		logging.FromContext(ctx).Error("In stops picker", logging.Err(err), logging.TrainNumberKey, data.TrainNumber)
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "Could not get the stations of this train.",
+				ShowAlert: true,
+			},
+		}
+	}
+	return &handlers.HandlerResponse{
+		Message: &bot.SendMessageParams{
+			Text:        fmt.Sprintf(chooseFromMessage, data.TrainNumber, data.Date.In(utils.Location).Format("02.01.2006")),
+			ReplyMarkup: getStopsKeyboard(data, group, handlers.TrainInfoChooseFromCallbackQuery, 0, 0),
+		},
+	}
+}
+
+// HandleStopsCallback saves the station chosen with the stops picker and either
+// continues with the next choice or refreshes the tracked message, which is
+// rendered with the given grace period, see PollingConfig.
+func (sub *Subscriptions) HandleStopsCallback(ctx context.Context, ref MessageRef, callbackKind string, stationIdx int, gracePeriod time.Duration) *handlers.HandlerResponse {
+	data, ok := sub.GetSubscription(ref)
+	if !ok {
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "You are no longer subscribed to this train.",
+				ShowAlert: true,
+			},
+		}
+	}
+	group, err := sub.getSubscribedGroup(ctx, data)
+	if err != nil || stationIdx >= len(group.Stations) {
+		if err != nil {
+			logging.FromContext(ctx).Error("In stops picker", logging.Err(err), logging.TrainNumberKey, data.TrainNumber)
+		}
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "Could not get the stations of this train.",
+				ShowAlert: true,
+			},
+		}
+	}
+
+	stops := data.Stops()
+	dateString := data.Date.In(utils.Location).Format("02.01.2006")
+	if callbackKind == handlers.TrainInfoChooseFromCallbackQuery {
+		stops = handlers.TrainStops{}
+		if stationIdx >= 0 {
+			stops.From = group.Stations[stationIdx].Name
+		}
+	} else if stationIdx >= 0 {
+		stops.To = group.Stations[stationIdx].Name
+	}
+	data, err = sub.UpdateStops(ref, stops)
+	if err != nil {
+		logging.FromContext(ctx).Error("Saving stops", "ref", ref.String(), logging.Err(err))
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "Error when saving your stations.",
+				ShowAlert: true,
+			},
+		}
+	}
+
+	if callbackKind == handlers.TrainInfoChooseFromCallbackQuery && stationIdx >= 0 {
+		return &handlers.HandlerResponse{
+			MessageEdits: []*bot.EditMessageTextParams{
+				{
+					Text:        fmt.Sprintf(chooseToMessage, data.TrainNumber, dateString),
+					ReplyMarkup: getStopsKeyboard(data, group, handlers.TrainInfoChooseToCallbackQuery, stationIdx+1, 0),
+				},
+			},
+		}
+	}
+
+	from, to := group.Stations[0].Name, group.Stations[len(group.Stations)-1].Name
+	if len(stops.From) != 0 {
+		from = stops.From
+	}
+	if len(stops.To) != 0 {
+		to = stops.To
+	}
+	response := &handlers.HandlerResponse{
+		MessageEdits: []*bot.EditMessageTextParams{
+			{
+				Text: fmt.Sprintf(stopsSetMessage, data.TrainNumber, dateString, from, to),
+			},
+		},
+	}
+	trainResponse, ok := handlers.HandleTrainNumberCommandWithStops(ctx, sub.source, data.TrainNumber, data.Date, data.GroupIndex, true, stops, gracePeriod)
+	if ok && trainResponse != nil && trainResponse.Message != nil {
+		edit := ref.EditTextParams(trainResponse.Message.Text, trainResponse.Message.Entities, trainResponse.Message.ReplyMarkup)
+		edit.ParseMode = trainResponse.Message.ParseMode
+		edit.DisableWebPagePreview = trainResponse.Message.DisableWebPagePreview
+		response.MessageEdits = append(response.MessageEdits, edit)
+	}
+	return response
+}
+
+func (sub *Subscriptions) getSubscribedGroup(ctx context.Context, data *SubData) (*api.TrainGroup, error) {
+	trainData, err := sub.source.GetTrain(ctx, data.TrainNumber, data.Date)
+	if err != nil {
+		return nil, err
+	}
+	if data.GroupIndex < 0 || data.GroupIndex >= len(trainData.Groups) || len(trainData.Groups[data.GroupIndex].Stations) == 0 {
+		return nil, fmt.Errorf("group %d of train %s not found", data.GroupIndex, data.TrainNumber)
+	}
+	return &trainData.Groups[data.GroupIndex], nil
+}
+
+// HandleStopsPageCallback shows another page of the stations of the stops
+// picker.
+func (sub *Subscriptions) HandleStopsPageCallback(ctx context.Context, ref MessageRef, callbackKind string, firstIdx int, page int) *handlers.HandlerResponse {
+	data, ok := sub.GetSubscription(ref)
+	if !ok {
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "You are no longer subscribed to this train.",
+				ShowAlert: true,
+			},
+		}
+	}
+	group, err := sub.getSubscribedGroup(ctx, data)
+	if err != nil {
+		logging.FromContext(ctx).Error("In stops picker", logging.Err(err), logging.TrainNumberKey, data.TrainNumber)
+		return &handlers.HandlerResponse{
+			CallbackAnswer: &bot.AnswerCallbackQueryParams{
+				Text:      "Could not get the stations of this train.",
+				ShowAlert: true,
+			},
+		}
+	}
+	return &handlers.HandlerResponse{
+		MessageMarkupEdits: []*bot.EditMessageReplyMarkupParams{
+			{
+				ReplyMarkup: getStopsKeyboard(data, group, callbackKind, firstIdx, page),
+			},
+		},
+	}
+}
+
+// getStopsKeyboard lists one page of the stations that can be chosen,
+// starting from firstIdx.
+func getStopsKeyboard(data *SubData, group *api.TrainGroup, callbackKind string, firstIdx int, page int) models.InlineKeyboardMarkup {
+	candidates := make([]int, 0, len(group.Stations))
+	for i := firstIdx; i < len(group.Stations); i++ {
+		station := &group.Stations[i]
+		if callbackKind == handlers.TrainInfoChooseFromCallbackQuery && station.Departure == nil {
+			continue
+		}
+		if callbackKind == handlers.TrainInfoChooseToCallbackQuery && station.Arrival == nil {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	pageCount := (len(candidates) + stopsPerPage - 1) / stopsPerPage
+	if page >= pageCount {
+		page = pageCount - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+	first := page * stopsPerPage
+	last := first + stopsPerPage
+	if last > len(candidates) {
+		last = len(candidates)
+	}
+
+	replyButtons := make([][]models.InlineKeyboardButton, 0, stopsPerPage/2+3)
+	replyButtons = append(replyButtons, []models.InlineKeyboardButton{
+		{
+			Text:         wholeRouteButton,
+			CallbackData: fmt.Sprintf(callbackKind+"\x1b%d\x1b%d", data.MessageId, -1),
+		},
+	})
+	row := make([]models.InlineKeyboardButton, 0, 2)
+	for _, i := range candidates[first:last] {
+		row = append(row, models.InlineKeyboardButton{
+			Text:         group.Stations[i].Name,
+			CallbackData: fmt.Sprintf(callbackKind+"\x1b%d\x1b%d", data.MessageId, i),
+		})
+		if len(row) == 2 {
+			replyButtons = append(replyButtons, row)
+			row = make([]models.InlineKeyboardButton, 0, 2)
+		}
+	}
+	if len(row) > 0 {
+		replyButtons = append(replyButtons, row)
+	}
+
+	pageButtons := make([]models.InlineKeyboardButton, 0, 2)
+	if page > 0 {
+		pageButtons = append(pageButtons, models.InlineKeyboardButton{
+			Text:         handlers.PreviousPageButton,
+			CallbackData: fmt.Sprintf(handlers.TrainInfoStopsPageCallbackQuery+"\x1b%s\x1b%d\x1b%d\x1b%d", callbackKind, data.MessageId, firstIdx, page-1),
+		})
+	}
+	if page+1 < pageCount {
+		pageButtons = append(pageButtons, models.InlineKeyboardButton{
+			Text:         handlers.NextPageButton,
+			CallbackData: fmt.Sprintf(handlers.TrainInfoStopsPageCallbackQuery+"\x1b%s\x1b%d\x1b%d\x1b%d", callbackKind, data.MessageId, firstIdx, page+1),
+		})
+	}
+	if len(pageButtons) > 0 {
+		replyButtons = append(replyButtons, pageButtons)
+	}
+	return models.InlineKeyboardMarkup{
+		InlineKeyboard: replyButtons,
+	}
+}
@@ -0,0 +1,79 @@
+package subscriptions
+
+import (
+	"gorm.io/gorm"
+)
+
+// SubscriptionStore persists subscriptions and commutes.
+type SubscriptionStore struct {
+	db *gorm.DB
+}
+
+func NewSubscriptionStore(db *gorm.DB) *SubscriptionStore {
+	return &SubscriptionStore{
+		db: db,
+	}
+}
+
+func (store *SubscriptionStore) All() ([]SubData, error) {
+	subs := make([]SubData, 0)
+	err := store.db.Find(&subs).Error
+	return subs, err
+}
+
+func (store *SubscriptionStore) Insert(data *SubData) error {
+	return store.db.Create(data).Error
+}
+
+// Update saves the given columns of data.
+func (store *SubscriptionStore) Update(data *SubData, columns ...string) error {
+	return store.db.Select(columns).Save(data).Error
+}
+
+func (store *SubscriptionStore) Delete(data *SubData) error {
+	return store.db.Delete(data).Error
+}
+
+// DeleteChat deletes all subscriptions of a chat.
+func (store *SubscriptionStore) DeleteChat(chatId int64) error {
+	return store.db.Delete(&SubData{}, "chat_id = ?", chatId).Error
+}
+
+// ReplaceChat replaces all subscriptions of a chat with data.
+func (store *SubscriptionStore) ReplaceChat(chatId int64, data []SubData) error {
+	return store.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&SubData{}, "chat_id = ?", chatId).Error; err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		return tx.Create(&data).Error
+	})
+}
+
+func (store *SubscriptionStore) AllCommutes() ([]Commute, error) {
+	commutes := make([]Commute, 0)
+	err := store.db.Find(&commutes).Error
+	return commutes, err
+}
+
+func (store *SubscriptionStore) InsertCommute(commute *Commute) error {
+	return store.db.Create(commute).Error
+}
+
+// UpdateCommute saves the given columns of commute.
+func (store *SubscriptionStore) UpdateCommute(commute *Commute, columns ...string) error {
+	return store.db.Select(columns).Save(commute).Error
+}
+
+// ClaimCommute marks the commute as spawned on day, unless it already was,
+// possibly by another instance. It returns whether the commute was claimed.
+func (store *SubscriptionStore) ClaimCommute(commute *Commute, day string) (bool, error) {
+	result := store.db.Model(commute).Where("last_spawned <> ?", day).Update("last_spawned", day)
+	return result.RowsAffected != 0, result.Error
+}
+
+func (store *SubscriptionStore) DeleteCommute(commute *Commute) error {
+	return store.db.Delete(commute).Error
+}
@@ -0,0 +1,266 @@
+package subscriptions
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/database"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
+)
+
+func newTestStore(t *testing.T) *SubscriptionStore {
+	t.Helper()
+	db, err := database.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSubscriptionStore(db)
+}
+
+func newTestSubData(chatId int64, messageId int, trainNumber string) SubData {
+	return SubData{
+		ChatId:      chatId,
+		MessageId:   messageId,
+		TrainNumber: trainNumber,
+		Date:        time.Date(2024, time.June, 10, 12, 0, 0, 0, utils.Location),
+	}
+}
+
+// chatMessages returns the ids of the saved messages of every chat.
+func chatMessages(t *testing.T, store *SubscriptionStore) map[int64][]int {
+	t.Helper()
+	subs, err := store.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[int64][]int{}
+	for _, data := range subs {
+		messages[data.ChatId] = append(messages[data.ChatId], data.MessageId)
+	}
+	for chatId := range messages {
+		sort.Ints(messages[chatId])
+	}
+	return messages
+}
+
+func TestSubscriptionStoreInsertAndUpdate(t *testing.T) {
+	store := newTestStore(t)
+	data := newTestSubData(1, 10, "1741")
+	data.Notify.DelayThreshold = 5
+	if err := store.Insert(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the given columns are saved
+	data.FromStation = "Predeal"
+	data.NotifyState.LastPlatform = "3"
+	if err := store.Update(&data, "notify_state_last_platform"); err != nil {
+		t.Fatal(err)
+	}
+
+	subs, err := store.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 {
+		t.Fatalf("expected 1 subscription, got %d", len(subs))
+	}
+	saved := subs[0]
+	if saved.TrainNumber != "1741" || !saved.Date.Equal(data.Date) || saved.Notify.DelayThreshold != 5 {
+		t.Errorf("expected the inserted subscription, got %+v", saved)
+	}
+	if saved.NotifyState.LastPlatform != "3" {
+		t.Errorf("expected the platform to be saved, got %q", saved.NotifyState.LastPlatform)
+	}
+	if len(saved.FromStation) != 0 {
+		t.Errorf("expected the station not to be saved, got %q", saved.FromStation)
+	}
+}
+
+func TestSubscriptionStoreReplaceChat(t *testing.T) {
+	store := newTestStore(t)
+	for _, data := range []SubData{newTestSubData(1, 10, "1741"), newTestSubData(1, 11, "1622"), newTestSubData(2, 20, "1741")} {
+		if err := store.Insert(&data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.ReplaceChat(1, []SubData{newTestSubData(1, 12, "531")}); err != nil {
+		t.Fatal(err)
+	}
+	messages := chatMessages(t, store)
+	if len(messages[1]) != 1 || messages[1][0] != 12 {
+		t.Errorf("expected chat 1 to only have message 12, got %v", messages[1])
+	}
+	if len(messages[2]) != 1 || messages[2][0] != 20 {
+		t.Errorf("expected chat 2 to be unchanged, got %v", messages[2])
+	}
+
+	if err := store.ReplaceChat(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	messages = chatMessages(t, store)
+	if len(messages[1]) != 0 || len(messages[2]) != 1 {
+		t.Errorf("expected only chat 2 to have subscriptions, got %v", messages)
+	}
+}
+
+func TestSubscriptionStoreDelete(t *testing.T) {
+	store := newTestStore(t)
+	subs := []SubData{newTestSubData(1, 10, "1741"), newTestSubData(1, 11, "1622"), newTestSubData(2, 20, "1741")}
+	for i := range subs {
+		if err := store.Insert(&subs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(&subs[0]); err != nil {
+		t.Fatal(err)
+	}
+	messages := chatMessages(t, store)
+	if len(messages[1]) != 1 || messages[1][0] != 11 {
+		t.Errorf("expected chat 1 to only have message 11, got %v", messages[1])
+	}
+
+	if err := store.DeleteChat(1); err != nil {
+		t.Fatal(err)
+	}
+	messages = chatMessages(t, store)
+	if len(messages[1]) != 0 || len(messages[2]) != 1 {
+		t.Errorf("expected only chat 2 to have subscriptions, got %v", messages)
+	}
+}
+
+func TestSubscriptionStoreCommutes(t *testing.T) {
+	store := newTestStore(t)
+	commute := Commute{
+		ChatId:      1,
+		TrainNumber: "1741",
+		Weekdays:    1 << time.Monday,
+		WindowStart: 6 * 60,
+		WindowEnd:   7 * 60,
+	}
+	if err := store.InsertCommute(&commute); err != nil {
+		t.Fatal(err)
+	}
+
+	commute.Paused = true
+	if err := store.UpdateCommute(&commute, "paused"); err != nil {
+		t.Fatal(err)
+	}
+	commutes, err := store.AllCommutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commutes) != 1 || !commutes[0].Paused || commutes[0].WindowEnd != 7*60 {
+		t.Errorf("expected the paused commute, got %+v", commutes)
+	}
+
+	if err := store.DeleteCommute(&commute); err != nil {
+		t.Fatal(err)
+	}
+	if commutes, err := store.AllCommutes(); err != nil || len(commutes) != 0 {
+		t.Errorf("expected no commutes, got %+v, %v", commutes, err)
+	}
+}
+
+func TestSubscriptionStoreClaimCommute(t *testing.T) {
+	store := newTestStore(t)
+	commute := Commute{
+		ChatId:      1,
+		TrainNumber: "1741",
+	}
+	if err := store.InsertCommute(&commute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance holding a stale copy must not claim the same day
+	stale := commute
+	for i, claim := range []struct {
+		commute  *Commute
+		day      string
+		expected bool
+	}{
+		{&commute, "2024-06-10", true},
+		{&stale, "2024-06-10", false},
+		{&stale, "2024-06-11", true},
+	} {
+		claimed, err := store.ClaimCommute(claim.commute, claim.day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != claim.expected {
+			t.Errorf("claim %d of %s: expected %v, got %v", i, claim.day, claim.expected, claimed)
+		}
+	}
+}
+
+func TestSubscriptionStoreLeases(t *testing.T) {
+	store := newTestStore(t)
+	key := trainKey{trainNumber: "1741", day: "2024-06-10"}
+	now := time.Now()
+
+	if ok, _, err := store.AcquireLease(key, "a", now, now.Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("expected a to get the lease, got %v, %v", ok, err)
+	}
+	ok, expires, err := store.AcquireLease(key, "b", now, now.Add(time.Minute))
+	if err != nil || ok {
+		t.Fatalf("expected b not to get the lease, got %v, %v", ok, err)
+	}
+	// Ignoring the precision lost in the database
+	if diff := expires.Sub(now.Add(time.Minute)); diff < -time.Millisecond || diff > time.Millisecond {
+		t.Errorf("expected the lease of a to expire at %v, got %v", now.Add(time.Minute), expires)
+	}
+	// The owner can renew its lease
+	if ok, _, err := store.AcquireLease(key, "a", now, now.Add(time.Minute*2)); err != nil || !ok {
+		t.Fatalf("expected a to renew the lease, got %v, %v", ok, err)
+	}
+
+	// Others take over once it expires
+	later := now.Add(time.Minute * 3)
+	if ok, _, err := store.AcquireLease(key, "b", later, later.Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("expected b to take over the expired lease, got %v, %v", ok, err)
+	}
+	if ok, _, err := store.AcquireLease(key, "a", later, later.Add(time.Minute)); err != nil || ok {
+		t.Fatalf("expected a to have lost the lease, got %v, %v", ok, err)
+	}
+
+	if err := store.ReleaseLeases("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := store.AcquireLease(key, "a", later, later.Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("expected a to get the released lease, got %v, %v", ok, err)
+	}
+}
+
+func TestReloadSeesOtherInstances(t *testing.T) {
+	store := newTestStore(t)
+	sub, err := LoadSubscriptions(store, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := newTestSubData(1, 10, "1741")
+	if err := sub.InsertSubscription(local); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written by another instance sharing the database
+	other := newTestSubData(2, 20, "1622")
+	if err := store.Insert(&other); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub.GetSubscription(other.Ref()); ok {
+		t.Fatal("expected the other instance's subscription to be unknown before reloading")
+	}
+
+	if err := sub.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Count() != 2 {
+		t.Errorf("expected 2 subscriptions, got %d", sub.Count())
+	}
+	if _, ok := sub.GetSubscription(other.Ref()); !ok {
+		t.Error("expected the other instance's subscription after reloading")
+	}
+}
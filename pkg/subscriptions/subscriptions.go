@@ -2,47 +2,168 @@ package subscriptions
 
 import (
 	"context"
+	"crypto/sha256"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/api"
 	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/handlers"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/health"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/logging"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/metrics"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/outbound"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/go-telegram/bot"
-	"log"
+	"github.com/go-telegram/bot/models"
 	"sync"
 	"time"
 
-	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/database"
+	"dcdev.ro/CfrTrainInfoTelegramBot/pkg/utils"
 	"gorm.io/gorm"
 )
 
 type SubData struct {
 	gorm.Model
-	ChatId      int64
-	MessageId   int
-	TrainNumber string
-	Date        time.Time
-	GroupIndex  int
+	ChatId          int64
+	MessageId       int
+	InlineMessageId string
+	TrainNumber     string
+	Date            time.Time
+	GroupIndex      int
+	// Optional boarding and alighting stations, see handlers.TrainStops
+	FromStation string
+	ToStation   string
+	Notify      NotificationRules `gorm:"embedded;embeddedPrefix:notify_"`
+	NotifyState NotificationState `gorm:"embedded;embeddedPrefix:notify_state_"`
+}
+
+// MessageRef identifies a tracked message, either by chat and message id or,
+// for messages sent via inline mode, by inline message id.
+type MessageRef struct {
+	ChatId          int64
+	MessageId       int
+	InlineMessageId string
+}
+
+func (data *SubData) Ref() MessageRef {
+	return MessageRef{
+		ChatId:          data.ChatId,
+		MessageId:       data.MessageId,
+		InlineMessageId: data.InlineMessageId,
+	}
+}
+
+func (ref MessageRef) IsInline() bool {
+	return len(ref.InlineMessageId) != 0
+}
+
+func (ref MessageRef) String() string {
+	if ref.IsInline() {
+		return fmt.Sprintf("inline message %s", ref.InlineMessageId)
+	}
+	return fmt.Sprintf("chat %d message %d", ref.ChatId, ref.MessageId)
+}
+
+// EditTextParams returns the parameters to edit the referenced message,
+// adapting the keyboard for inline messages if needed.
+func (ref MessageRef) EditTextParams(text string, entities []models.MessageEntity, replyMarkup models.ReplyMarkup) *bot.EditMessageTextParams {
+	params := &bot.EditMessageTextParams{
+		Text:        text,
+		Entities:    entities,
+		ReplyMarkup: replyMarkup,
+	}
+	if ref.IsInline() {
+		params.InlineMessageID = ref.InlineMessageId
+		params.ReplyMarkup = handlers.GetInlineCompatibleMarkup(replyMarkup)
+	} else {
+		params.ChatID = ref.ChatId
+		params.MessageID = ref.MessageId
+	}
+	return params
+}
+
+// EditMarkupParams returns the parameters to edit the keyboard of the
+// referenced message, adapting it for inline messages if needed.
+func (ref MessageRef) EditMarkupParams(replyMarkup models.ReplyMarkup) *bot.EditMessageReplyMarkupParams {
+	params := &bot.EditMessageReplyMarkupParams{
+		ReplyMarkup: replyMarkup,
+	}
+	if ref.IsInline() {
+		params.InlineMessageID = ref.InlineMessageId
+		params.ReplyMarkup = handlers.GetInlineCompatibleMarkup(replyMarkup)
+	} else {
+		params.ChatID = ref.ChatId
+		params.MessageID = ref.MessageId
+	}
+	return params
 }
 
 type Subscriptions struct {
-	mutex sync.RWMutex
-	data  map[int64][]SubData
-	tgBot *bot.Bot
+	mutex    sync.RWMutex
+	data     map[MessageRef]SubData
+	commutes map[uint]Commute
+	store    *SubscriptionStore
+	sender   *outbound.Sender
+	source   api.TrainDataSource
+	// Hashes of the content of the tracked messages, see renderedHash
+	rendered map[MessageRef]string
+	// Incremented by every change of data or commutes, see reload
+	changes uint64
 }
 
-func LoadSubscriptions(tgBot *bot.Bot) (*Subscriptions, error) {
-	subs := make([]SubData, 0)
-	_, err := database.ReadDB(func(db *gorm.DB) (*gorm.DB, error) {
-		result := db.Find(&subs)
-		return result, result.Error
-	})
-	result := map[int64][]SubData{}
-	for _, sub := range subs {
-		result[sub.ChatId] = append(result[sub.ChatId], sub)
+func LoadSubscriptions(store *SubscriptionStore, sender *outbound.Sender, source api.TrainDataSource) (*Subscriptions, error) {
+	sub := &Subscriptions{
+		mutex:    sync.RWMutex{},
+		data:     map[MessageRef]SubData{},
+		commutes: map[uint]Commute{},
+		store:    store,
+		sender:   sender,
+		source:   source,
+		rendered: map[MessageRef]string{},
+	}
+	return sub, sub.reload()
+}
+
+// reload reads the subscriptions and commutes from the database again, to
+// see the changes made by other instances sharing it. If this instance
+// changed them while reading, the result may be missing those changes, so
+// it is dropped until the next reload.
+func (sub *Subscriptions) reload() error {
+	sub.mutex.RLock()
+	changes := sub.changes
+	sub.mutex.RUnlock()
+
+	subs, err := sub.store.All()
+	if err != nil {
+		return err
 	}
-	return &Subscriptions{
-		mutex: sync.RWMutex{},
-		data:  result,
-		tgBot: tgBot,
-	}, err
+	commutes, err := sub.store.AllCommutes()
+	if err != nil {
+		return err
+	}
+	data := make(map[MessageRef]SubData, len(subs))
+	for _, d := range subs {
+		data[d.Ref()] = d
+	}
+	commutesById := make(map[uint]Commute, len(commutes))
+	for _, commute := range commutes {
+		commutesById[commute.ID] = commute
+	}
+
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.changes != changes {
+		return nil
+	}
+	sub.data = data
+	sub.commutes = commutesById
+	return nil
+}
+
+// lockChange locks the subscriptions to change them. It must be unlocked
+// with mutex.Unlock.
+func (sub *Subscriptions) lockChange() {
+	sub.mutex.Lock()
+	sub.changes++
 }
 
 func (sub *Subscriptions) Replace(chatId int64, data []SubData) error {
@@ -52,199 +173,470 @@ func (sub *Subscriptions) Replace(chatId int64, data []SubData) error {
 			return fmt.Errorf("data contains item whose ChatId (%d) doesn't match chatId (%d)", d.ChatId, chatId)
 		}
 	}
-	sub.mutex.Lock()
+	sub.lockChange()
 	defer sub.mutex.Unlock()
-	sub.data[chatId] = data
-	_, err := database.WriteDB(func(db *gorm.DB) (*gorm.DB, error) {
-		db.Delete(&SubData{}, "chat_id = ?", chatId)
-		db.Create(&data)
-		return db, db.Error
-	})
-	return err
+	if err := sub.store.ReplaceChat(chatId, data); err != nil {
+		return err
+	}
+	for ref := range sub.data {
+		if !ref.IsInline() && ref.ChatId == chatId {
+			delete(sub.data, ref)
+		}
+	}
+	for _, d := range data {
+		sub.data[d.Ref()] = d
+	}
+	return nil
 }
 
 func (sub *Subscriptions) InsertSubscription(data SubData) error {
-	sub.mutex.Lock()
+	sub.lockChange()
 	defer sub.mutex.Unlock()
-	datas := sub.data[data.ChatId]
-	datas = append(datas, data)
-	sub.data[data.ChatId] = datas
-	_, err := database.WriteDB(func(db *gorm.DB) (*gorm.DB, error) {
-		db.Create(&data)
-		return db, db.Error
-	})
-	return err
+	if err := sub.store.Insert(&data); err != nil {
+		return err
+	}
+	sub.data[data.Ref()] = data
+	return nil
 }
 
 func (sub *Subscriptions) DeleteChat(chatId int64) error {
-	sub.mutex.Lock()
+	sub.lockChange()
 	defer sub.mutex.Unlock()
-	delete(sub.data, chatId)
-	_, err := database.WriteDB(func(db *gorm.DB) (*gorm.DB, error) {
-		db.Delete(&SubData{}, "chat_id = ?", chatId)
-		return db, db.Error
-	})
-	return err
+	if err := sub.store.DeleteChat(chatId); err != nil {
+		return err
+	}
+	for ref := range sub.data {
+		if !ref.IsInline() && ref.ChatId == chatId {
+			delete(sub.data, ref)
+		}
+	}
+	return nil
 }
 
-func (sub *Subscriptions) DeleteSubscription(chatId int64, messageId int) (*SubData, error) {
-	sub.mutex.Lock()
+func (sub *Subscriptions) GetSubscription(ref MessageRef) (*SubData, bool) {
+	sub.mutex.RLock()
+	defer sub.mutex.RUnlock()
+	result, ok := sub.data[ref]
+	return &result, ok
+}
+
+// Count returns the number of tracked messages.
+func (sub *Subscriptions) Count() int {
+	sub.mutex.RLock()
+	defer sub.mutex.RUnlock()
+	return len(sub.data)
+}
+
+func (sub *Subscriptions) UpdateNotificationRules(ref MessageRef, rules NotificationRules) (*SubData, error) {
+	sub.lockChange()
 	defer sub.mutex.Unlock()
-	datas := sub.data[chatId]
-	deleteIndex := -1
-	for i := range datas {
-		if datas[i].MessageId == messageId {
-			deleteIndex = i
-			break
-		}
-	}
-	var result SubData
-	if deleteIndex != -1 {
-		result = datas[deleteIndex]
-		datas[deleteIndex] = datas[len(datas)-1]
-		datas = datas[:len(datas)-1]
-
-		_, err := database.WriteDB(func(db *gorm.DB) (*gorm.DB, error) {
-			db.Delete(&result)
-			return db, db.Error
-		})
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		return nil, fmt.Errorf("subscription chatId %d messageId %d not found", chatId, messageId)
+	data, ok := sub.data[ref]
+	if !ok {
+		return nil, fmt.Errorf("subscription for %s not found", ref)
 	}
-	if len(datas) == 0 {
-		delete(sub.data, chatId)
-	} else {
-		sub.data[chatId] = datas
+	data.Notify = rules
+	err := sub.store.Update(&data, "notify_delay_threshold", "notify_cancellation", "notify_platform_change", "notify_departure")
+	if err != nil {
+		return nil, err
 	}
+	sub.data[ref] = data
+	return &data, nil
+}
+
+func (sub *Subscriptions) updateNotificationState(ref MessageRef, state NotificationState) error {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	data, ok := sub.data[ref]
+	if !ok {
+		// Deleted in the meantime
+		return nil
+	}
+	data.NotifyState = state
+	sub.data[ref] = data
+	return sub.store.Update(&data, "notify_state_delay_notified", "notify_state_cancellation_notified", "notify_state_last_platform", "notify_state_departure_notified")
+}
+
+func (sub *Subscriptions) DeleteSubscription(ref MessageRef) (*SubData, error) {
+	sub.lockChange()
+	defer sub.mutex.Unlock()
+	result, ok := sub.data[ref]
+	if !ok {
+		return nil, fmt.Errorf("subscription for %s not found", ref)
+	}
+	if err := sub.store.Delete(&result); err != nil {
+		return nil, err
+	}
+	delete(sub.data, ref)
 	return &result, nil
 }
 
-func (sub *Subscriptions) CheckSubscriptions(ctx context.Context) {
-	ticker := time.NewTicker(time.Second * 45)
+// CheckSubscriptions updates the subscribed messages until ctx is done. Each
+// train run is checked on its own schedule, see PollingConfig, by the
+// instance holding its lease, see TrainLease.
+func (sub *Subscriptions) CheckSubscriptions(ctx context.Context, polling PollingConfig) {
+	// Commutes are due at a certain minute, and new subscriptions are only
+	// picked up when waking up
+	spawnTicker := time.NewTicker(time.Minute)
+	defer spawnTicker.Stop()
+	defer func() {
+		if err := sub.store.ReleaseLeases(polling.InstanceId); err != nil {
+			logging.FromContext(ctx).Error("Releasing train leases", logging.Err(err))
+		}
+	}()
 
-	sub.executeChecks(ctx)
+	schedule := newCheckSchedule()
+	firstCheck := time.Now()
+	sub.spawnCommutes(ctx, polling)
 	for {
+		health.MarkSubscriptionTick()
+		now := time.Now()
+		schedule.sync(sub.trainKeys(), firstCheck)
+		// The messages of new subscriptions were just sent
+		firstCheck = now.Add(polling.MinInterval)
+
+		if due := schedule.popDue(now); len(due) > 0 {
+			leased, retries := sub.acquireLeases(ctx, due, polling)
+			for key, next := range retries {
+				schedule.set(key, next)
+			}
+			if len(leased) == 0 {
+				continue
+			}
+			start := time.Now()
+			intervals := sub.executeChecks(ctx, leased, polling)
+			metrics.SubscriptionCheckDuration.Observe(time.Since(start).Seconds())
+			for _, key := range leased {
+				interval, ok := intervals[key]
+				if !ok {
+					interval = polling.MinInterval
+				}
+				next := time.Now().Add(interval)
+				if ok && !sub.renewLease(ctx, key, next, polling) {
+					// Picked up again by sync, then only checked once the
+					// lease is acquired again
+					continue
+				}
+				schedule.set(key, next)
+			}
+			continue
+		}
+
+		wait := time.Minute
+		if next, ok := schedule.next(); ok && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
 		select {
-		case <-ticker.C:
-			sub.executeChecks(ctx)
+		case <-timer.C:
+		case <-spawnTicker.C:
+			timer.Stop()
+			if err := sub.reload(); err != nil {
+				logging.FromContext(ctx).Error("Reloading subscriptions", logging.Err(err))
+			}
+			if err := sub.store.DeleteExpiredLeases(time.Now().Add(-time.Hour)); err != nil {
+				logging.FromContext(ctx).Error("Deleting expired train leases", logging.Err(err))
+			}
+			sub.spawnCommutes(ctx, polling)
 		case <-ctx.Done():
+			timer.Stop()
 			return
 		}
 	}
 }
 
-type workerData struct {
-	tgBot *bot.Bot
-	data  SubData
+// trainKey identifies a run of a train. Subscriptions with the same key are
+// updated from a single lookup.
+type trainKey struct {
+	trainNumber string
+	day         string
+}
+
+func (data *SubData) trainKey() trainKey {
+	return trainKey{
+		trainNumber: data.TrainNumber,
+		day:         data.Date.In(utils.Location).Format("2006-01-02"),
+	}
+}
+
+func (sub *Subscriptions) trainKeys() map[trainKey]bool {
+	sub.mutex.RLock()
+	defer sub.mutex.RUnlock()
+	keys := make(map[trainKey]bool, len(sub.data))
+	for _, data := range sub.data {
+		keys[data.trainKey()] = true
+	}
+	return keys
 }
 
-type unsubscribe struct {
-	chatId    int64
-	messageId int
+type workerData struct {
+	sender  *outbound.Sender
+	source  api.TrainDataSource
+	polling PollingConfig
+	key     trainKey
+	subs    []SubData
+	// The hash of the last content set for each message, see renderedHash
+	rendered map[MessageRef]string
 }
 
 type workerResponseData struct {
-	unsubscribe *unsubscribe
+	ref               MessageRef
+	unsubscribe       bool
+	notificationState *NotificationState
+	// The message was deleted, so there is nothing left to update
+	messageGone bool
+	// The bot was blocked or removed from the chat
+	chatGone bool
+	// The hash of the content of the message after this check, if known
+	renderedHash string
 }
 
-func (sub *Subscriptions) executeChecks(ctx context.Context) {
+type workerResult struct {
+	key       trainKey
+	interval  time.Duration
+	responses []*workerResponseData
+}
+
+// executeChecks checks the given train runs and updates their subscribers,
+// returning when each train should be checked next.
+func (sub *Subscriptions) executeChecks(ctx context.Context, keys []trainKey, polling PollingConfig) map[trainKey]time.Duration {
 	sub.mutex.RLock()
+	jobs := make(map[trainKey]*workerData, len(keys))
+	for _, key := range keys {
+		jobs[key] = &workerData{
+			sender:   sub.sender,
+			source:   sub.source,
+			polling:  polling,
+			key:      key,
+			rendered: map[MessageRef]string{},
+		}
+	}
+	for ref, data := range sub.data {
+		job, ok := jobs[data.trainKey()]
+		if !ok {
+			continue
+		}
+		job.subs = append(job.subs, data)
+		if hash, ok := sub.rendered[ref]; ok {
+			job.rendered[ref] = hash
+		}
+	}
+	sub.mutex.RUnlock()
 
-	// Only allow 8 concurrent requests
-	// TODO: Make configurable instead of hardcoded
-	workerCount := 8
-	workerChan := make(chan workerData, workerCount)
-	responseChan := make(chan *workerResponseData, workerCount)
+	// Limit the number of concurrent requests
+	workerCount := polling.WorkerCount
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	workerChan := make(chan *workerData, workerCount)
+	responseChan := make(chan *workerResult, workerCount)
 	defer close(responseChan)
 	for i := 0; i < workerCount; i++ {
 		go checkWorker(ctx, workerChan, responseChan)
 	}
 
 	go func() {
-		for _, datas := range sub.data {
-			for i := range datas {
-				workerChan <- workerData{
-					tgBot: sub.tgBot,
-					data:  datas[i],
-				}
+		for _, job := range jobs {
+			// Deleted since the check was scheduled
+			if len(job.subs) == 0 {
+				continue
 			}
+			workerChan <- job
 		}
 		close(workerChan)
 	}()
 
-	responses := make([]*workerResponseData, 0, len(sub.data))
-
-	for _, datas := range sub.data {
-		for range datas {
-			if resp := <-responseChan; resp != nil && resp.unsubscribe != nil {
-				responses = append(responses, resp)
-			}
+	intervals := make(map[trainKey]time.Duration, len(jobs))
+	responses := make([]*workerResponseData, 0, len(jobs))
+	for _, job := range jobs {
+		if len(job.subs) == 0 {
+			continue
 		}
+		result := <-responseChan
+		intervals[result.key] = result.interval
+		responses = append(responses, result.responses...)
 	}
 
-	sub.mutex.RUnlock()
-
+	deletedChats := map[int64]bool{}
 	for i := range responses {
-		if responses[i].unsubscribe != nil {
+		ref := responses[i].ref
+		switch {
+		case responses[i].chatGone:
+			if !deletedChats[ref.ChatId] {
+				logging.FromContext(ctx).Info("Can't send messages to chat anymore, removing its subscriptions", logging.ChatIdKey, ref.ChatId)
+				if err := sub.DeleteChat(ref.ChatId); err != nil {
+					logging.FromContext(ctx).Error("Removing subscriptions of chat", logging.ChatIdKey, ref.ChatId, logging.Err(err))
+				}
+				deletedChats[ref.ChatId] = true
+			}
+			continue
+		case responses[i].messageGone:
+			logging.FromContext(ctx).Info("Tracked message is gone, removing its subscription", "ref", ref.String(), logging.ChatIdKey, ref.ChatId)
+			if _, err := sub.DeleteSubscription(ref); err != nil {
+				logging.FromContext(ctx).Error("Removing subscription", "ref", ref.String(), logging.ChatIdKey, ref.ChatId, logging.Err(err))
+			}
+			continue
+		}
+		if responses[i].notificationState != nil {
+			if err := sub.updateNotificationState(responses[i].ref, *responses[i].notificationState); err != nil {
+				logging.FromContext(ctx).Error("Saving notification state", "ref", ref.String(), logging.ChatIdKey, ref.ChatId, logging.Err(err))
+			}
+		}
+		if responses[i].unsubscribe {
 			// Ignore error since this is optional optimisation
-			deletedSub, err := sub.DeleteSubscription(responses[i].unsubscribe.chatId, responses[i].unsubscribe.messageId)
+			deletedSub, err := sub.DeleteSubscription(responses[i].ref)
 			if err == nil && deletedSub != nil {
-				_, _ = sub.tgBot.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
-					ChatID:      responses[i].unsubscribe.chatId,
-					MessageID:   responses[i].unsubscribe.messageId,
-					ReplyMarkup: handlers.GetTrainNumberCommandResponseButtons(deletedSub.TrainNumber, deletedSub.Date, deletedSub.GroupIndex, handlers.TrainInfoResponseButtonExcludeSub),
-				})
+				_, _ = sub.sender.EditMessageReplyMarkup(ctx, responses[i].ref.EditMarkupParams(
+					handlers.GetTrainNumberCommandResponseButtons(deletedSub.TrainNumber, deletedSub.Date, deletedSub.GroupIndex, handlers.TrainInfoResponseButtonExcludeSub),
+				))
 			}
 		}
 	}
+
+	sub.mutex.Lock()
+	for _, resp := range responses {
+		if len(resp.renderedHash) != 0 {
+			sub.rendered[resp.ref] = resp.renderedHash
+		} else {
+			delete(sub.rendered, resp.ref)
+		}
+	}
+	for ref := range sub.rendered {
+		if _, ok := sub.data[ref]; !ok {
+			delete(sub.rendered, ref)
+		}
+	}
+	sub.mutex.Unlock()
+	return intervals
 }
 
-func checkWorker(ctx context.Context, workerChan <-chan workerData, responseChan chan<- *workerResponseData) {
+// renderedVariant identifies the ways a train is rendered for its subscribers.
+type renderedVariant struct {
+	groupIndex int
+	stops      handlers.TrainStops
+}
+
+func checkWorker(ctx context.Context, workerChan <-chan *workerData, responseChan chan<- *workerResult) {
 	for wData := range workerChan {
 		func() {
-			var response *workerResponseData
+			result := &workerResult{
+				key:       wData.key,
+				interval:  wData.polling.ErrorInterval,
+				responses: make([]*workerResponseData, 0, len(wData.subs)),
+			}
 			defer func() {
-				responseChan <- response
+				responseChan <- result
 			}()
-			data := wData.data
-			log.Printf("DEBUG: Timer tick, update for chat %d, train %s, date %s, group %d", data.ChatId, data.TrainNumber, data.Date.Format("2006-01-02"), data.GroupIndex)
-
-			resp, ok := handlers.HandleTrainNumberCommand(ctx, data.TrainNumber, data.Date, data.GroupIndex, true)
-
-			if !ok || resp == nil || resp.Message == nil {
-				// Silently discard update errors
-				log.Printf("DEBUG: Error when updating chat %d, train %s, date %s, group %d", data.ChatId, data.TrainNumber, data.Date.Format("2006-01-02"), data.GroupIndex)
-				if resp != nil && resp.ShouldUnsubscribe {
-					response = &workerResponseData{
-						unsubscribe: &unsubscribe{
-							chatId:    data.ChatId,
-							messageId: data.MessageId,
-						},
+			first := &wData.subs[0]
+			ctx := logging.With(ctx, logging.TrainNumberKey, first.TrainNumber, "date", first.Date.Format("2006-01-02"))
+			logging.FromContext(ctx).Debug("Checking train", "messages", len(wData.subs))
+
+			trainData, err := wData.source.GetTrain(ctx, first.TrainNumber, first.Date)
+			groupIndexes := make([]int, 0, len(wData.subs))
+			for i := range wData.subs {
+				groupIndexes = append(groupIndexes, wData.subs[i].GroupIndex)
+			}
+			result.interval = wData.polling.nextCheckInterval(trainData, groupIndexes, time.Now())
+			type renderResult struct {
+				resp *handlers.HandlerResponse
+				ok   bool
+			}
+			variants := map[renderedVariant]renderResult{}
+
+			for i := range wData.subs {
+				data := wData.subs[i]
+				ref := data.Ref()
+
+				variant := renderedVariant{
+					groupIndex: data.GroupIndex,
+					stops:      data.Stops(),
+				}
+				r, cached := variants[variant]
+				if !cached {
+					r.resp, r.ok = handlers.RenderTrainResponse(ctx, trainData, err, data.TrainNumber, data.Date, data.GroupIndex, true, data.Stops(), wData.polling.UnsubscribeGracePeriod)
+					variants[variant] = r
+				}
+				resp := r.resp
+
+				if !r.ok || resp == nil || resp.Message == nil {
+					// Silently discard update errors
+					logging.FromContext(ctx).Debug("Error when updating", "ref", ref.String(), logging.ChatIdKey, ref.ChatId, "group_index", data.GroupIndex)
+					if resp != nil && resp.ShouldUnsubscribe {
+						result.responses = append(result.responses, &workerResponseData{
+							ref:         ref,
+							unsubscribe: true,
+						})
 					}
+					continue
 				}
-				return
-			}
 
-			_, _ = wData.tgBot.EditMessageText(ctx, &bot.EditMessageTextParams{
-				ChatID:                data.ChatId,
-				MessageID:             data.MessageId,
-				Text:                  resp.Message.Text,
-				ParseMode:             resp.Message.ParseMode,
-				Entities:              resp.Message.Entities,
-				DisableWebPagePreview: resp.Message.DisableWebPagePreview,
-				ReplyMarkup:           resp.Message.ReplyMarkup,
-			})
-
-			response = &workerResponseData{}
-			if resp.ShouldUnsubscribe {
-				response.unsubscribe = &unsubscribe{
-					chatId:    data.ChatId,
-					messageId: data.MessageId,
+				response := &workerResponseData{
+					ref:          ref,
+					unsubscribe:  resp.ShouldUnsubscribe,
+					renderedHash: renderedHash(resp.Message),
+				}
+				result.responses = append(result.responses, response)
+
+				if wData.rendered[ref] != response.renderedHash {
+					edit := ref.EditTextParams(resp.Message.Text, resp.Message.Entities, resp.Message.ReplyMarkup)
+					edit.ParseMode = resp.Message.ParseMode
+					edit.DisableWebPagePreview = resp.Message.DisableWebPagePreview
+					_, err := wData.sender.EditMessageText(ctx, edit)
+					switch outbound.ClassifyError(err) {
+					case outbound.ErrorNotModified:
+						// Already up to date
+					case outbound.ErrorMessageGone:
+						response.messageGone = true
+						continue
+					case outbound.ErrorChatGone:
+						if ref.IsInline() {
+							response.messageGone = true
+						} else {
+							response.chatGone = true
+						}
+						continue
+					default:
+						if err != nil {
+							// Try again on the next check
+							response.renderedHash = ""
+						}
+					}
+				}
+
+				// Messages sent via inline mode have no chat to notify
+				if !ref.IsInline() && data.Notify.Any() {
+					notifications, state := evaluateNotifications(&data, resp.TrainData)
+					for _, notification := range notifications {
+						_, err := wData.sender.SendMessage(ctx, &bot.SendMessageParams{
+							ChatID:                   ref.ChatId,
+							Text:                     notification,
+							ReplyToMessageID:         ref.MessageId,
+							AllowSendingWithoutReply: true,
+						})
+						if err != nil {
+							logging.FromContext(ctx).Error("Sending notification", "ref", ref.String(), logging.ChatIdKey, ref.ChatId, logging.Err(err))
+							if outbound.ClassifyError(err) == outbound.ErrorChatGone {
+								response.chatGone = true
+								break
+							}
+						}
+					}
+					if state != data.NotifyState {
+						response.notificationState = &state
+					}
 				}
 			}
 		}()
 	}
 }
+
+// renderedHash summarises the content of a message, to skip editing messages
+// whose content didn't change since the last check.
+func renderedHash(message *bot.SendMessageParams) string {
+	hash := sha256.New()
+	hash.Write([]byte(message.Text))
+	entities, _ := json.Marshal(message.Entities)
+	hash.Write(entities)
+	markup, _ := json.Marshal(message.ReplyMarkup)
+	hash.Write(markup)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,9 @@
+package utils
+
+import "unicode/utf16"
+
+// UTF16Len returns the length of s in UTF-16 code units, which is what
+// Telegram uses for message entity offsets and lengths.
+func UTF16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}